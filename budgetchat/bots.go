@@ -0,0 +1,309 @@
+package budgetchat
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of the events bots receive
+const (
+	BOT_JOIN    = "join"
+	BOT_LEAVE   = "leave"
+	BOT_MESSAGE = "message"
+	BOT_RENAME  = "rename"
+	BOT_PRIVATE = "private"
+)
+
+// Something that happened in a bot's room, or a private message sent to it
+type BotEvent struct {
+	Type string
+	// Who joined, left, spoke, changed names or sent the private message
+	User string
+	// What was said, or the new name
+	Text string
+}
+
+// A Bot takes part in a room as a virtual user. It shows up in the room's
+// member list like anyone else, and what it says goes through the same rules
+// as what users say: it can be muted, kicked or banned, and is held to the
+// rate limit. It sees everything happening in its room except for its own
+// doings.
+//
+// Like commands, bots run on the server's event loop, so they see a
+// consistent view of the chat but must not block. They get events once
+// whatever caused them is done, taking turns with everything else, so that
+// bots answering each other can't hold up the server. Anything that needs to
+// happen later can be scheduled with BotSession.After.
+type Bot interface {
+	HandleEvent(s *BotSession, e BotEvent)
+}
+
+// BotFunc lets an ordinary function be used as a Bot
+type BotFunc func(s *BotSession, e BotEvent)
+
+func (f BotFunc) HandleEvent(s *BotSession, e BotEvent) {
+	f(s, e)
+}
+
+type roomBot struct {
+	name    string
+	room    string
+	bot     Bot
+	session *BotSession
+	limiter *rateLimiter
+}
+
+// Queue an event for the bot, to be handled on a later turn of the event loop
+func (b *roomBot) handle(e BotEvent) {
+	c := b.session.c
+	c.botEvents = append(c.botEvents, botDelivery{bot: b, event: e})
+}
+
+type botDelivery struct {
+	bot   *roomBot
+	event BotEvent
+}
+
+// Hand the queued events to their bots. Events queued meanwhile wait for the
+// next turn.
+func (c *chatServer) deliverBotEvents() {
+	deliveries := c.botEvents
+	c.botEvents = nil
+
+	for _, d := range deliveries {
+		// The bot may have been removed since
+		if d.bot.present() {
+			d.bot.bot.HandleEvent(d.bot.session, d.event)
+		}
+	}
+}
+
+// Place a bot in a room, creating the room if needed
+func (c *chatServer) addBot(name string, room string, bot Bot) error {
+	name, err := c.opts.NamePolicy.normalize(name)
+	if err != nil {
+		return err
+	}
+	if !isValidRoomName(room) {
+		return fmt.Errorf("Illegal room name")
+	}
+	if c.isTaken(name) {
+		return fmt.Errorf("Name already in use")
+	}
+
+	b := &roomBot{
+		name:    name,
+		room:    room,
+		bot:     bot,
+		limiter: newRateLimiter(c.opts.MessageRate, c.opts.MessageBurst),
+	}
+	b.session = &BotSession{c: c, b: b}
+
+	r, ok := c.rooms[room]
+	if !ok {
+		r = newChatRoom(room, c.opts)
+		c.rooms[room] = r
+	}
+	r.broadcast(chatEvent{Type: eventJoin, User: name})
+	r.notify(BotEvent{Type: BOT_JOIN, User: name})
+	r.bots[name] = b
+	r.record(TRANSCRIPT_JOIN, name, "")
+	c.bots[c.opts.NamePolicy.key(name)] = b
+	c.federate(peerEvent{Type: PEER_JOIN, Room: room, User: name})
+	return nil
+}
+
+// Whether the bot is still in its room, rather than kicked or banned
+func (b *roomBot) present() bool {
+	c := b.session.c
+	return c.bots[c.opts.NamePolicy.key(b.name)] == b
+}
+
+// Find a bot by name
+func (c *chatServer) lookupBot(name string) (*roomBot, bool) {
+	b, ok := c.bots[c.opts.NamePolicy.key(name)]
+	return b, ok
+}
+
+// Take a bot out of its room for good, as when it's kicked
+func (c *chatServer) removeBot(b *roomBot) {
+	r := c.rooms[b.room]
+	delete(r.bots, b.name)
+	delete(c.bots, c.opts.NamePolicy.key(b.name))
+	r.record(TRANSCRIPT_LEAVE, b.name, "")
+	r.broadcast(chatEvent{Type: eventLeave, User: b.name})
+	r.notify(BotEvent{Type: BOT_LEAVE, User: b.name})
+	c.federate(peerEvent{Type: PEER_QUIT, User: b.name})
+	c.removeIfEmpty(b.room)
+}
+
+// Let the room's bots know about something that happened in it
+func (c *chatRoom) notify(e BotEvent) {
+	for n, b := range c.bots {
+		if n != e.User {
+			b.handle(e)
+		}
+	}
+}
+
+// BotSession gives a bot access to the chat
+type BotSession struct {
+	c *chatServer
+	b *roomBot
+}
+
+// The name the bot goes by
+func (s *BotSession) Name() string {
+	return s.b.name
+}
+
+// The room the bot is in
+func (s *BotSession) Room() string {
+	return s.b.room
+}
+
+// Everyone in the bot's room, including itself
+func (s *BotSession) Members() []string {
+	return s.c.rooms[s.b.room].members()
+}
+
+// Send a message to everyone in the bot's room. Like what users say, it's
+// dropped if the bot is muted or over the rate limit.
+func (s *BotSession) Say(text string) {
+	if s.check() != nil {
+		return
+	}
+	text = s.c.moderation.censor(text)
+	s.c.post(s.b.room, s.b.name, text)
+}
+
+// Send a private message to a user
+func (s *BotSession) Whisper(user string, text string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.c.whisper(s.b.name, user, s.c.moderation.censor(text))
+}
+
+// Whether the bot can send anything right now
+func (s *BotSession) check() error {
+	if !s.b.present() {
+		return fmt.Errorf("Removed from the chat")
+	}
+	if s.c.moderation.isMuted(s.b.name) {
+		return fmt.Errorf("Muted")
+	}
+	if !s.b.limiter.allow() {
+		return fmt.Errorf("Sending messages too quickly")
+	}
+	return nil
+}
+
+// Run the function on the event loop after the given time, unless the server
+// or the bot is gone by then
+func (s *BotSession) After(d time.Duration, f func(s *BotSession)) {
+	time.AfterFunc(d, func() {
+		s.c.do(func() {
+			if s.b.present() {
+				f(s)
+			}
+		})
+	})
+}
+
+// A bot greeting everyone that enters its room with a private message
+func NewWelcomeBot(greeting string) Bot {
+	return BotFunc(func(s *BotSession, e BotEvent) {
+		if e.Type == BOT_JOIN {
+			s.Whisper(e.User, greeting)
+		}
+	})
+}
+
+// The most dice a single roll can have, and the most sides they can have
+const MAX_DICE = 100
+
+const MAX_DICE_SIDES = 1000
+
+var diceRegexp = regexp.MustCompile(`^!roll(?: (\d*)d(\d+))?$`)
+
+// A bot rolling dice for anyone saying `!roll`, or `!roll <n>d<sides>` for
+// something other than a single six-sided die
+func NewDiceBot() Bot {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	return BotFunc(func(s *BotSession, e BotEvent) {
+		if e.Type != BOT_MESSAGE {
+			return
+		}
+		m := diceRegexp.FindStringSubmatch(e.Text)
+		if m == nil {
+			return
+		}
+
+		n, sides := 1, 6
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if m[2] != "" {
+			sides, _ = strconv.Atoi(m[2])
+		}
+		if n < 1 || n > MAX_DICE || sides < 1 || sides > MAX_DICE_SIDES {
+			s.Say(fmt.Sprintf("%s: I can roll up to %d dice with up to %d sides", e.User, MAX_DICE, MAX_DICE_SIDES))
+			return
+		}
+
+		rolls := make([]string, n)
+		total := 0
+		for i := range rolls {
+			roll := random.Intn(sides) + 1
+			rolls[i] = strconv.Itoa(roll)
+			total += roll
+		}
+		s.Say(fmt.Sprintf("%s rolled %dd%d: %s (total %d)", e.User, n, sides, strings.Join(rolls, ", "), total))
+	})
+}
+
+// A bot reminding users of something after a while, when asked with
+// `!remind <duration> <text>` either in the room or in private
+func NewReminderBot() Bot {
+	return BotFunc(func(s *BotSession, e BotEvent) {
+		if e.Type != BOT_MESSAGE && e.Type != BOT_PRIVATE {
+			return
+		}
+		args, ok := cutCommand(e.Text, "!remind")
+		if !ok {
+			return
+		}
+
+		duration, text, _ := strings.Cut(args, " ")
+		d, err := time.ParseDuration(duration)
+		text = strings.TrimSpace(text)
+		if err != nil || d <= 0 || text == "" {
+			s.Whisper(e.User, "Usage: !remind <duration> <text>")
+			return
+		}
+
+		user := e.User
+		s.Whisper(user, fmt.Sprintf("I'll remind you in %s", d))
+		s.After(d, func(s *BotSession) {
+			// Users may have left, in which case there's nobody to remind
+			s.Whisper(user, "Reminder: "+text)
+		})
+	})
+}
+
+// Check whether the text is the given bot command, returning its arguments
+func cutCommand(text string, command string) (string, bool) {
+	if text == command {
+		return "", true
+	}
+	if !strings.HasPrefix(text, command+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(text[len(command):]), true
+}
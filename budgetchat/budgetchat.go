@@ -5,33 +5,346 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"protohackers/protos"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 )
 
+// The room every user is placed in after registering
+const DEFAULT_ROOM = "general"
+
+const DEFAULT_QUEUE_SIZE = 100
+
+const DEFAULT_HISTORY_SIZE = 100
+
+// How long a slow client gets to receive the notice before being disconnected
+const EVICTION_GRACE_PERIOD = time.Second
+
+// Clients sending longer lines than this are disconnected
+const MAX_LINE_SIZE = bufio.MaxScanTokenSize
+
+type Options struct {
+	// Maximum number of messages waiting to be sent to a single client.
+	// Defaults to DEFAULT_QUEUE_SIZE.
+	QueueSize int
+	// What to do when a client's queue is full
+	SlowClientPolicy SlowClientPolicy
+	// Number of messages kept for each room. Defaults to DEFAULT_HISTORY_SIZE,
+	// and a negative value disables history altogether.
+	HistorySize int
+	// Number of recent messages replayed to users when they join a room.
+	// Nothing is replayed if zero or negative.
+	ReplayOnJoin int
+	// If set, receives every join, leave and message in every room
+	Transcript TranscriptSink
+
+	// Which user names are acceptable
+	NamePolicy NamePolicy
+
+	// If set, also accept WebSocket clients on this address, at the path
+	// WEBSOCKET_PATH. They speak the same protocol as TCP clients, one line
+	// per text message, and share the same rooms.
+	WebSocketAddress string
+	// Origins of the pages allowed to connect over WebSocket, such as
+	// "https://chat.example.com". Pages from anywhere can connect if empty,
+	// which is harmless as the chat doesn't rely on cookies or any other
+	// credentials a browser would send on its own. Clients sending no origin
+	// at all aren't browsers, and are always let in.
+	WebSocketOrigins []string
+	// If set, also accept IRC clients on this address. Rooms show up as
+	// channels named after them.
+	IRCAddress string
+
+	// Users logging in as "<name> <secret>" with this secret become admins
+	// and can use the moderation commands. Admin logins are disabled if empty.
+	AdminSecret string
+	// Words replaced by asterisks in every message
+	BannedWords []string
+	// Maximum sustained number of lines per second a user can send, with
+	// bursts of up to MessageBurst lines. Unlimited if zero.
+	MessageRate  float64
+	MessageBurst int
+
+	// Users that haven't sent anything for this long are announced as idle
+	// to their room. Disabled if zero.
+	IdleTimeout time.Duration
+	// Whether room listings show who's away or idle next to their name
+	ShowStatus bool
+
+	// Identifies this server to the ones it's linked to, which must all have
+	// different names. A random one is picked if empty.
+	ServerName string
+	// Shared by every linked server, which have to present it to each other
+	// before anything else. Required to link servers.
+	PeerSecret string
+	// If set, accept links from other servers on this address
+	PeerAddress string
+	// Addresses of other servers to link to. Links are retried until the
+	// server is closed. Only one server of each pair needs to list the other,
+	// as a second link between the same two servers is dropped.
+	Peers []string
+}
+
 func Serve(address string) (protos.Server, error) {
+	return ServeWithOptions(address, Options{})
+}
+
+func ServeWithOptions(address string, opts Options) (protos.Server, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if opts.HistorySize == 0 {
+		opts.HistorySize = DEFAULT_HISTORY_SIZE
+	}
+	if opts.ServerName == "" {
+		opts.ServerName = randomServerName()
+	}
+	if (opts.PeerAddress != "" || len(opts.Peers) > 0) && opts.PeerSecret == "" {
+		return nil, fmt.Errorf("A peer secret is required to link servers")
+	}
+
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to listen: %s\n", err)
 	}
-	c := &chatRoom{}
+	c := newChatServer(opts)
+	s := &server{Listener: listener, chat: c}
+
+	if opts.WebSocketAddress != "" {
+		s.ws, s.wsListener, err = c.serveWebSocket(opts.WebSocketAddress)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if opts.IRCAddress != "" {
+		s.ircListener, err = c.serveIRC(opts.IRCAddress)
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+
+	if opts.PeerAddress != "" {
+		s.peerListener, err = c.servePeers(opts.PeerAddress)
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+
+	go c.run()
 	go protos.Serve(listener, c.handleConnection)
+	for _, address := range opts.Peers {
+		go c.dialPeer(address)
+	}
 
-	return &server{Listener: listener}, nil
+	return s, nil
 }
 
 type server struct {
 	net.Listener
+	chat *chatServer
+
+	ws         *http.Server
+	wsListener net.Listener
+
+	ircListener  net.Listener
+	peerListener net.Listener
 }
 
-type chatRoom struct {
-	users map[string](chan string)
-	mu    sync.Mutex
+// The address WebSocket clients can connect to, if enabled
+func (s *server) WebSocketAddr() net.Addr {
+	if s.wsListener == nil {
+		return nil
+	}
+	return s.wsListener.Addr()
+}
+
+// The address IRC clients can connect to, if enabled
+func (s *server) IRCAddr() net.Addr {
+	if s.ircListener == nil {
+		return nil
+	}
+	return s.ircListener.Addr()
+}
+
+// Add a bot to a room, creating the room if needed. Bots have names like
+// users do, which have to be available.
+func (s *server) AddBot(name string, room string, bot Bot) error {
+	var err error
+	if !s.chat.do(func() { err = s.chat.addBot(name, room, bot) }) {
+		return fmt.Errorf("Server is shutting down")
+	}
+	return err
+}
+
+// The address other servers can link to, if enabled
+func (s *server) PeerAddr() net.Addr {
+	if s.peerListener == nil {
+		return nil
+	}
+	return s.peerListener.Addr()
+}
+
+// Stop accepting connections and disconnect everyone
+func (s *server) Close() error {
+	err := s.closeListeners()
+	s.chat.shutdown()
+	return err
+}
+
+func (s *server) closeListeners() error {
+	err := s.Listener.Close()
+	if s.ws != nil {
+		s.ws.Close()
+	}
+	if s.ircListener != nil {
+		s.ircListener.Close()
+	}
+	if s.peerListener != nil {
+		s.peerListener.Close()
+	}
+	return err
+}
+
+// chatServer keeps track of the registered users and of the rooms they can
+// move between. Names are unique across the whole server, as well as across
+// the servers it's linked to, and users are indexed by their name policy key.
+//
+// All of its state is owned by a single goroutine running the event loop in
+// `run`, and everything else goes through `do` to read or modify it. This
+// makes every join, leave and message atomic with respect to each other
+// without any locking.
+type chatServer struct {
+	rooms      map[string]*chatRoom
+	users      map[string]*user
+	moderation *moderation
+	opts       Options
+
+	// Bots, by name policy key, and the events waiting to be handed to them
+	bots      map[string]*roomBot
+	botEvents []botDelivery
+
+	// Linked servers, and the users connected to them
+	name   string
+	peers  map[*peer]bool
+	remote map[string]*remoteUser
+
+	events chan func()
+	done   chan struct{}
+}
+
+func newChatServer(opts Options) *chatServer {
+	return &chatServer{
+		rooms:      map[string]*chatRoom{DEFAULT_ROOM: newChatRoom(DEFAULT_ROOM, opts)},
+		users:      make(map[string]*user),
+		moderation: newModeration(opts.BannedWords, opts.NamePolicy),
+		opts:       opts,
+		name:       opts.ServerName,
+		bots:       make(map[string]*roomBot),
+		peers:      make(map[*peer]bool),
+		remote:     make(map[string]*remoteUser),
+		events:     make(chan func()),
+		done:       make(chan struct{}),
+	}
+}
+
+type user struct {
+	name string
+	out  *outbox
+	room string
+	// The address the user connected from, and just its IP
+	addr    string
+	host    string
+	admin   bool
+	limiter *rateLimiter
+	// When the user registered and last sent something
+	joined     time.Time
+	lastActive time.Time
+	// Set by the user with /away
+	away string
+	// Whether the room has been told the user is idle
+	idle bool
+	// Set once the user has been told to go, after which anything else they
+	// send is ignored.
+	gone bool
+}
+
+// Stop sending anything else to the user, which in turn closes their
+// connection once what's already queued has been written.
+func (u *user) disconnect() {
+	u.gone = true
+	u.out.close()
+}
+
+func (c *chatServer) run() {
+	var idleChecks <-chan time.Time
+	if c.opts.IdleTimeout > 0 {
+		ticker := time.NewTicker(c.opts.IdleTimeout / IDLE_CHECKS_PER_TIMEOUT)
+		defer ticker.Stop()
+		idleChecks = ticker.C
+	}
+
+	// Always ready, for when bots have events waiting
+	ready := make(chan struct{})
+	close(ready)
+
+	for {
+		var botsWaiting <-chan struct{}
+		if len(c.botEvents) > 0 {
+			botsWaiting = ready
+		}
+
+		select {
+		case event := <-c.events:
+			event()
+		case now := <-idleChecks:
+			c.checkIdle(now)
+		case <-botsWaiting:
+			c.deliverBotEvents()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Run the function on the event loop and wait for it to finish. Returns false
+// without running it if the server has shut down.
+func (c *chatServer) do(f func()) bool {
+	finished := make(chan struct{})
+	event := func() {
+		f()
+		close(finished)
+	}
+
+	select {
+	case c.events <- event:
+	case <-c.done:
+		return false
+	}
+
+	<-finished
+	return true
 }
 
-func (c *chatRoom) handleConnection(conn net.Conn) {
+func (c *chatServer) shutdown() {
+	c.do(func() {
+		for _, u := range c.users {
+			u.disconnect()
+		}
+		for p := range c.peers {
+			p.out.close()
+		}
+		close(c.done)
+	})
+}
+
+func (c *chatServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	err := writeLine(conn, "Welcome to budgetchat! What shall I call you?")
@@ -42,46 +355,342 @@ func (c *chatRoom) handleConnection(conn net.Conn) {
 
 	scanner := bufio.NewScanner(conn)
 	scanner.Split(bufio.ScanLines)
+	scanner.Buffer(make([]byte, 4096), MAX_LINE_SIZE)
 
 	// Handle user registration
 	if !scanner.Scan() {
 		fmt.Printf("Failed to read message from client, disconnecting: %s\n", scanner.Err())
 		return
 	}
-	name := trimMessage(scanner.Text())
+	login := trimMessage(scanner.Text())
+
+	out := newOutbox(c.opts.QueueSize, c.opts.SlowClientPolicy, SLOW_CLIENT_NOTICE, func() {
+		// Give the writer a chance to deliver the notice, but don't wait
+		// forever on a client that isn't reading.
+		conn.SetWriteDeadline(time.Now().Add(EVICTION_GRACE_PERIOD))
+	})
 
-	recvChannel, err := c.join(name)
+	u, err := c.register(login, conn.RemoteAddr().String(), out)
 	if err != nil {
 		writeLine(conn, "* %s", err)
 		return
 	}
-	defer c.leave(name)
-
-	// Send received messages to the client in a separate goroutine
+	// Send received messages to the client in a separate goroutine. Closing
+	// the connection once the outbox is done also stops the read loop when
+	// the client is disconnected by the server.
+	written := make(chan struct{})
 	go func() {
-		for msg := range recvChannel {
-			writeLine(conn, msg)
+		defer close(written)
+		defer conn.Close()
+		for {
+			msg, ok := out.next()
+			if !ok {
+				return
+			}
+			if err := writeEvent(conn, msg); err != nil {
+				return
+			}
 		}
 	}()
 
+	// Let whatever was queued, such as the reason for being disconnected, go
+	// out before closing the connection, as long as the client is reading.
+	defer func() {
+		c.unregister(u)
+		conn.SetWriteDeadline(time.Now().Add(EVICTION_GRACE_PERIOD))
+		<-written
+	}()
+
 	// Read loop
 	for scanner.Scan() {
 		msg := trimMessage(scanner.Text())
-		c.broadcast(fmt.Sprintf("[%s] %s", name, msg), name)
+		if !c.handleMessage(u, msg) {
+			return
+		}
 	}
 
 	// Leave
 	fmt.Printf("Failed to read message from client, disconnecting: %s\n", scanner.Err())
-	c.broadcast(fmt.Sprintf("* %s has left the room", name), name)
-	return
 }
 
-func (c *chatRoom) broadcast(msg string, exceptions ...string) {
-	// Wrap the manipulation of the users in a mutex.
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Process a line sent by a registered user. Returns false if the connection
+// should be closed.
+func (c *chatServer) handleMessage(u *user, msg string) bool {
+	open := false
+	c.do(func() {
+		if u.gone {
+			return
+		}
+		c.touch(u)
+
+		switch {
+		case !c.checkRate(u):
+			// Over the limit, the line is dropped
+		case isCommand(msg, u.admin):
+			c.runCommand(u, msg)
+		case c.moderation.isMuted(u.name):
+			u.out.pushLine("* You are muted")
+		default:
+			c.post(u.room, u.name, c.moderation.censor(msg))
+		}
+		open = !u.gone
+	})
+	return open
+}
 
-	for n, ch := range c.users {
+// Register a user given the line they logged in with, which is either just
+// their name or their name and the admin secret separated by a space.
+func (c *chatServer) register(login string, addr string, out *outbox) (*user, error) {
+	name, secret, isAdmin := strings.Cut(login, " ")
+	if isAdmin && c.opts.AdminSecret == "" {
+		return nil, fmt.Errorf("Illegal name provided, disconnecting!")
+	}
+	name, err := c.opts.NamePolicy.normalize(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s, disconnecting!", err)
+	}
+	if isAdmin && secret != c.opts.AdminSecret {
+		return nil, fmt.Errorf("Invalid admin secret, disconnecting!")
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	now := time.Now()
+	u := &user{
+		name:       name,
+		out:        out,
+		addr:       addr,
+		host:       host,
+		admin:      isAdmin,
+		limiter:    newRateLimiter(c.opts.MessageRate, c.opts.MessageBurst),
+		joined:     now,
+		lastActive: now,
+	}
+
+	ok := c.do(func() {
+		if c.moderation.isBanned(name, host) {
+			err = fmt.Errorf("You are banned, disconnecting!")
+			return
+		}
+		if c.isTaken(name) {
+			err = fmt.Errorf("Name already in use, disconnecting!")
+			return
+		}
+		c.users[c.opts.NamePolicy.key(name)] = u
+		c.move(u, DEFAULT_ROOM)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Server is shutting down, disconnecting!")
+	}
+
+	return u, err
+}
+
+func (c *chatServer) unregister(u *user) {
+	c.do(func() {
+		c.move(u, "")
+		delete(c.users, c.opts.NamePolicy.key(u.name))
+		u.disconnect()
+		c.federate(peerEvent{Type: PEER_QUIT, User: u.name})
+	})
+}
+
+// Change the name of a registered user, announcing it to their room
+func (c *chatServer) rename(u *user, name string) error {
+	name, err := c.opts.NamePolicy.normalize(name)
+	if err != nil {
+		return err
+	}
+	// Changing the case of one's own name is fine
+	if other, ok := c.lookup(name); ok && other != u {
+		return fmt.Errorf("Name already in use")
+	}
+	if _, ok := c.remote[c.opts.NamePolicy.key(name)]; ok {
+		return fmt.Errorf("Name already in use")
+	}
+	if _, ok := c.bots[c.opts.NamePolicy.key(name)]; ok {
+		return fmt.Errorf("Name already in use")
+	}
+
+	old := u.name
+	delete(c.users, c.opts.NamePolicy.key(old))
+	c.users[c.opts.NamePolicy.key(name)] = u
+	u.name = name
+
+	// Don't let anyone get away with a mute by changing names
+	c.moderation.rename(old, name)
+
+	c.rooms[u.room].rename(old, name)
+	c.federate(peerEvent{Type: PEER_RENAME, User: old, Text: name})
+	return nil
+}
+
+// Find a registered user by name
+func (c *chatServer) lookup(name string) (*user, bool) {
+	u, ok := c.users[c.opts.NamePolicy.key(name)]
+	return u, ok
+}
+
+// Whether a name is used by anyone, here or on a linked server
+func (c *chatServer) isTaken(name string) bool {
+	if _, ok := c.lookup(name); ok {
+		return true
+	}
+	if _, ok := c.bots[c.opts.NamePolicy.key(name)]; ok {
+		return true
+	}
+	_, ok := c.remote[c.opts.NamePolicy.key(name)]
+	return ok
+}
+
+// Send something a user said to everyone else in their room, including those
+// on linked servers
+func (c *chatServer) post(room string, sender string, text string) {
+	c.rooms[room].post(chatEvent{Type: eventMessage, User: sender, Text: text})
+	c.federate(peerEvent{Type: PEER_MESSAGE, Room: room, User: sender, Text: text})
+}
+
+// Send something a user did, as with /me, to everyone else in their room
+func (c *chatServer) act(room string, sender string, text string) {
+	c.rooms[room].post(chatEvent{Type: eventAction, User: sender, Text: text})
+	c.federate(peerEvent{Type: PEER_ACTION, Room: room, User: sender, Text: text})
+}
+
+// Send a server message on behalf of a user to everyone else in their room
+func (c *chatServer) announce(room string, sender string, text string) {
+	c.rooms[room].post(chatEvent{Type: eventNotice, User: sender, Text: text})
+	c.federate(peerEvent{Type: PEER_NOTICE, Room: room, User: sender, Text: text})
+}
+
+// Deliver a private message, wherever the recipient is
+func (c *chatServer) whisper(from string, to string, text string) error {
+	key := c.opts.NamePolicy.key(to)
+
+	if c.deliver(from, to, text) {
+		return nil
+	}
+	if ru, ok := c.remote[key]; ok {
+		if p := c.peerNamed(ru.server); p != nil {
+			p.out.pushLine(encodePeerEvent(peerEvent{Type: PEER_PRIVATE, User: from, To: ru.name, Text: text}))
+		}
+		return nil
+	}
+	return fmt.Errorf("No such user: %s", to)
+}
+
+// Deliver a private message to a user or bot on this server, if there's one
+// with that name
+func (c *chatServer) deliver(from string, to string, text string) bool {
+	key := c.opts.NamePolicy.key(to)
+
+	if u, ok := c.users[key]; ok {
+		u.out.push(chatEvent{Type: eventPrivate, User: from, To: u.name, Text: text})
+		return true
+	}
+	if b, ok := c.bots[key]; ok {
+		b.handle(BotEvent{Type: BOT_PRIVATE, User: from, Text: text})
+		return true
+	}
+	return false
+}
+
+// Move a user from their current room (if any) into the given one, creating
+// it if needed. An empty room name just takes the user out of their current
+// room. Rooms other than the default one are removed once they're empty.
+func (c *chatServer) move(u *user, room string) {
+	if u.room != "" {
+		c.rooms[u.room].leave(u.name)
+		c.federate(peerEvent{Type: PEER_LEAVE, Room: u.room, User: u.name})
+		c.removeIfEmpty(u.room)
+	}
+
+	u.room = room
+	if room == "" {
+		return
+	}
+
+	r, ok := c.rooms[room]
+	if !ok {
+		r = newChatRoom(room, c.opts)
+		c.rooms[room] = r
+	}
+	r.join(u, c.opts.ReplayOnJoin)
+	c.federate(peerEvent{Type: PEER_JOIN, Room: room, User: u.name})
+}
+
+func (c *chatServer) removeIfEmpty(room string) {
+	if room != DEFAULT_ROOM && c.rooms[room].size() == 0 {
+		delete(c.rooms, room)
+	}
+}
+
+// Describe every room along with the number of users in it, sorted by name
+func (c *chatServer) roomList() []string {
+	rooms := make([]string, 0, len(c.rooms))
+	for name, r := range c.rooms {
+		rooms = append(rooms, fmt.Sprintf("%s (%d)", name, r.size()))
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// A chatRoom is only ever accessed from its server's event loop
+type chatRoom struct {
+	name  string
+	users map[string]*user
+	// Users on linked servers, by name, along with the server they're on
+	remote     map[string]string
+	bots       map[string]*roomBot
+	history    *history
+	transcript TranscriptSink
+	showStatus bool
+}
+
+func newChatRoom(name string, opts Options) *chatRoom {
+	return &chatRoom{
+		name:       name,
+		users:      make(map[string]*user),
+		remote:     make(map[string]string),
+		bots:       make(map[string]*roomBot),
+		history:    newHistory(opts.HistorySize),
+		transcript: opts.Transcript,
+		showStatus: opts.ShowStatus,
+	}
+}
+
+// Send something one of the users said or did to everyone else, and
+// remember it
+func (c *chatRoom) post(e chatEvent) {
+	msg := e.String()
+	c.history.add(msg)
+	c.record(TRANSCRIPT_MESSAGE, e.User, msg)
+	c.broadcast(e, e.User)
+
+	// Bots get what was said, or the whole line for anything else
+	if e.Type == eventMessage {
+		msg = e.Text
+	}
+	c.notify(BotEvent{Type: BOT_MESSAGE, User: e.User, Text: msg})
+}
+
+func (c *chatRoom) record(eventType string, name string, text string) {
+	if c.transcript == nil {
+		return
+	}
+
+	err := c.transcript.Record(TranscriptEvent{
+		Time: time.Now(),
+		Type: eventType,
+		Room: c.name,
+		User: name,
+		Text: text,
+	})
+	if err != nil {
+		fmt.Printf("Failed to record transcript: %s\n", err)
+	}
+}
+
+func (c *chatRoom) broadcast(msg chatEvent, exceptions ...string) {
+	for n, u := range c.users {
 		skip := false
 		for _, e := range exceptions {
 			if e == n {
@@ -92,52 +701,95 @@ func (c *chatRoom) broadcast(msg string, exceptions ...string) {
 		if skip {
 			continue
 		}
-		ch <- msg
+		u.out.push(msg)
 	}
 }
 
-func (c *chatRoom) join(name string) (chan string, error) {
-	if !isValidName(name) {
-		return nil, fmt.Errorf("Illegal name provided, disconnecting!")
+func (c *chatRoom) join(u *user, replay int) {
+	u.out.push(chatEvent{Type: eventJoined, Room: c.name, Members: c.listing()})
+
+	// Catch up on what was said recently
+	for _, entry := range c.history.last(replay) {
+		u.out.pushLine(entry.String())
 	}
 
-	// Wrap the manipulation of the users in a mutex.
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// Announce to others in the room
+	c.broadcast(chatEvent{Type: eventJoin, User: u.name})
 
-	for n := range c.users {
-		if n == name {
-			return nil, fmt.Errorf("Name already in use, disconnecting!")
-		}
-	}
+	c.users[u.name] = u
+	c.record(TRANSCRIPT_JOIN, u.name, "")
+	c.notify(BotEvent{Type: BOT_JOIN, User: u.name})
+}
 
-	usernames := make([]string, 0, len(c.users))
-	for n := range c.users {
-		usernames = append(usernames, n)
-	}
+func (c *chatRoom) leave(name string) {
+	delete(c.users, name)
+	c.record(TRANSCRIPT_LEAVE, name, "")
+	c.broadcast(chatEvent{Type: eventLeave, User: name})
+	c.notify(BotEvent{Type: BOT_LEAVE, User: name})
+}
 
-	recvChannel := make(chan string, 10)
+func (c *chatRoom) rename(old string, name string) {
+	c.users[name] = c.users[old]
+	delete(c.users, old)
+	c.record(TRANSCRIPT_RENAME, old, name)
+	c.broadcast(chatEvent{Type: eventRename, User: old, Text: name})
+	c.notify(BotEvent{Type: BOT_RENAME, User: old, Text: name})
+}
 
-	recvChannel <- fmt.Sprintf("* The room contains: %s", strings.Join(usernames, ", "))
+// A user from a linked server entered the room
+func (c *chatRoom) remoteJoin(name string, server string) {
+	c.broadcast(chatEvent{Type: eventJoin, User: name})
+	c.remote[name] = server
+	c.record(TRANSCRIPT_JOIN, name, "")
+	c.notify(BotEvent{Type: BOT_JOIN, User: name})
+}
 
-	// Announce to others in the room
-	c.mu.Unlock()
-	c.broadcast(fmt.Sprintf("* %s has entered the room", name))
-	c.mu.Lock()
+func (c *chatRoom) remoteLeave(name string) {
+	delete(c.remote, name)
+	c.record(TRANSCRIPT_LEAVE, name, "")
+	c.broadcast(chatEvent{Type: eventLeave, User: name})
+	c.notify(BotEvent{Type: BOT_LEAVE, User: name})
+}
 
-	// Ensure map creation before assignment
-	if c.users == nil {
-		c.users = make(map[string](chan string))
+func (c *chatRoom) remoteRename(old string, name string) {
+	c.remote[name] = c.remote[old]
+	delete(c.remote, old)
+	c.record(TRANSCRIPT_RENAME, old, name)
+	c.broadcast(chatEvent{Type: eventRename, User: old, Text: name})
+	c.notify(BotEvent{Type: BOT_RENAME, User: old, Text: name})
+}
+
+// Number of users in the room, wherever they're connected, including bots
+func (c *chatRoom) size() int {
+	return len(c.users) + len(c.remote) + len(c.bots)
+}
+
+func (c *chatRoom) members() []string {
+	usernames := make([]string, 0, c.size())
+	for n := range c.users {
+		usernames = append(usernames, n)
+	}
+	for n := range c.remote {
+		usernames = append(usernames, n)
+	}
+	for n := range c.bots {
+		usernames = append(usernames, n)
 	}
+	sort.Strings(usernames)
+	return usernames
+}
 
-	c.users[name] = recvChannel
-	return recvChannel, nil
+// A connection that takes chat events as they are, rather than the lines
+// they're shown as
+type eventWriter interface {
+	writeEvent(e chatEvent) error
 }
 
-func (c *chatRoom) leave(name string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.users, name)
+func writeEvent(conn net.Conn, e chatEvent) error {
+	if w, ok := conn.(eventWriter); ok {
+		return w.writeEvent(e)
+	}
+	return writeLine(conn, "%s", e)
 }
 
 func writeLine(w io.Writer, s string, args ...any) error {
@@ -145,9 +797,10 @@ func writeLine(w io.Writer, s string, args ...any) error {
 	return err
 }
 
-func isValidName(name string) bool {
-	matched, _ := regexp.MatchString(`^[a-zA-Z0-9]+$`, name)
-	return matched
+var roomNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+func isValidRoomName(name string) bool {
+	return roomNameRegexp.MatchString(name)
 }
 
 func trimMessage(msg string) string {
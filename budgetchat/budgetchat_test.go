@@ -2,14 +2,24 @@ package budgetchat_test
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"protohackers/budgetchat"
+	"protohackers/protos"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestNewClientIsAskedForTestNewClientIsAskedForItsName(t *testing.T) {
@@ -359,16 +369,1943 @@ func TestExampleSession(t *testing.T) {
 	assertServerMessage(t, msg, "dave")
 }
 
-// Assert that the message is a message sent server (starts with `*`) and contains the
-// expected strings
-func assertServerMessage(t *testing.T, m string, expected ...string) {
-	if !strings.HasPrefix(m, "*") {
-		t.Fatalf("%s does not start with character `*`", m)
+func TestUsersCanMoveBetweenRooms(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
 	}
+	defer server.Close()
 
-	for _, s := range expected {
-		if !strings.Contains(m, s) {
-			t.Fatalf("%s does not contain expected substring %s", m, s)
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	charlie := joinChat(t, server.Addr().String(), "charlie")
+	defer charlie.Close()
+
+	// Skip the join announcements
+	expectMessages(t, alice, "* bob has entered the room", "* charlie has entered the room")
+	expectMessages(t, bob, "* charlie has entered the room")
+
+	// bob moves to a new room, leaving alice and charlie behind
+	bob.Send("/join games")
+	expectMessages(t, bob, "* The room contains: ")
+	expectMessages(t, alice, "* bob has left the room")
+	expectMessages(t, charlie, "* bob has left the room")
+
+	// charlie follows and gets to see bob in there
+	charlie.Send("/join games")
+	expectMessages(t, charlie, "* The room contains: bob")
+	expectMessages(t, bob, "* charlie has entered the room")
+	expectMessages(t, alice, "* charlie has left the room")
+
+	// Messages stay within the room
+	bob.Send("anyone here?")
+	expectMessages(t, charlie, "[bob] anyone here?")
+	alice.Send("so quiet")
+
+	alice.Send("/rooms")
+	expectMessages(t, alice, "* Rooms: games (2), general (1)")
+
+	// Leaving returns to the default room
+	charlie.Send("/leave")
+	expectMessages(t, charlie, "* The room contains: alice")
+	expectMessages(t, alice, "* charlie has entered the room")
+	expectMessages(t, bob, "* charlie has left the room")
+}
+
+func TestEmptyRoomsAreRemoved(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	alice.Send("/join lonely")
+	expectMessages(t, alice, "* The room contains: ")
+	alice.Send("/rooms")
+	expectMessages(t, alice, "* Rooms: general (0), lonely (1)")
+
+	alice.Send("/leave")
+	expectMessages(t, alice, "* The room contains: ")
+	alice.Send("/rooms")
+	expectMessages(t, alice, "* Rooms: general (1)")
+}
+
+func TestNamesAreUniqueAcrossRooms(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	alice.Send("/join elsewhere")
+	expectMessages(t, alice, "* The room contains: ")
+
+	impostor, err := makeClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	defer impostor.Close()
+
+	impostor.Recv()
+	impostor.Send("alice")
+
+	msg, err := impostor.Recv()
+	if err == nil {
+		assertServerMessage(t, msg, "in use")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	expectMessages(t, alice, "* bob has entered the room")
+
+	t.Run("who", func(t *testing.T) {
+		alice.Send("/who")
+		expectMessages(t, alice, "* The room contains: alice, bob")
+	})
+
+	t.Run("me", func(t *testing.T) {
+		alice.Send("/me waves")
+		expectMessages(t, bob, "* alice waves")
+	})
+
+	t.Run("msg", func(t *testing.T) {
+		bob.Send("/msg alice psst")
+		expectMessages(t, alice, "[bob -> alice] psst")
+
+		bob.Send("/msg nobody psst")
+		expectMessages(t, bob, "* No such user: nobody")
+
+		bob.Send("/msg alice")
+		expectMessages(t, bob, "* Usage: /msg <user> <text>")
+	})
+
+	t.Run("nick", func(t *testing.T) {
+		bob.Send("/nick alice")
+		expectMessages(t, bob, "* Name already in use")
+
+		bob.Send("/nick bad_name")
+		expectMessages(t, bob, "* Illegal name")
+
+		bob.Send("/nick robert")
+		expectMessages(t, bob, "* bob is now known as robert")
+		expectMessages(t, alice, "* bob is now known as robert")
+
+		alice.Send("/msg robert hi")
+		expectMessages(t, bob, "[alice -> robert] hi")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		// Anything that isn't a command is still a message, as it's always been
+		alice.Send("/dance")
+		expectMessages(t, bob, "[alice] /dance")
+		alice.Send("/ shrug")
+		expectMessages(t, bob, "[alice] / shrug")
+
+		// Commands can be said rather than run
+		alice.Send("/say /who")
+		expectMessages(t, bob, "[alice] /who")
+	})
+
+	t.Run("quit", func(t *testing.T) {
+		alice.Send("/quit")
+		expectMessages(t, bob, "* alice has left the room")
+
+		// The scanner reports a clean EOF as an empty message without error
+		msg, err := alice.Recv()
+		if err != nil || msg != "" {
+			t.Fatalf("Expected to be disconnected, got `%s` (%v)", msg, err)
+		}
+	})
+}
+
+func TestCustomCommandsCanBeRegistered(t *testing.T) {
+	budgetchat.RegisterCommand("shout", budgetchat.Command{
+		Usage: "/shout <text>",
+		Help:  "Say something loudly",
+		Run: func(s *budgetchat.Session, args string) error {
+			if args == "" {
+				return fmt.Errorf("Shout what?")
+			}
+			s.Say(strings.ToUpper(args) + "!")
+			return nil
+		},
+	})
+	budgetchat.RegisterCommand("flip", budgetchat.Command{
+		Usage: "/flip",
+		Help:  "Flip a coin",
+		Run: func(s *budgetchat.Session, args string) error {
+			s.Announce(fmt.Sprintf("%s flipped a coin: heads", s.Name()))
+			return nil
+		},
+	})
+
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{BannedWords: []string{"darn"}})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+
+	alice.Send("/shout")
+	expectMessages(t, alice, "* bob has entered the room", "* Shout what?")
+
+	// What commands say goes through the same filter as what users say
+	alice.Send("/shout darn it")
+	expectMessages(t, bob, "[alice] **** IT!")
+	alice.Send("/flip")
+	expectMessages(t, bob, "* alice flipped a coin: heads")
+
+	// And reaches linked servers too
+	servers := startFederation(t, "a", "b")
+	for _, s := range servers {
+		defer s.Close()
+	}
+	carol := joinChat(t, servers[0].Addr().String(), "carol")
+	defer carol.Close()
+	dave := joinChat(t, servers[1].Addr().String(), "dave")
+	defer dave.Close()
+	waitForMembers(t, dave, "carol, dave")
+
+	carol.Send("/shout hello")
+	expectMessages(t, dave, "[carol] HELLO!")
+	carol.Send("/flip")
+	expectMessages(t, dave, "* carol flipped a coin: heads")
+}
+
+// Send numbered messages from one client in lockstep with another one
+// receiving them, so that only stalled clients fall behind. Returns the
+// server notices the receiver got along the way.
+func floodRoom(t *testing.T, sender *client, receiver *client, n int) []string {
+	padding := strings.Repeat("x", 1024)
+	notices := []string{}
+
+	for i := 0; i < n; i++ {
+		err := sender.Send(fmt.Sprintf("%d %s", i, padding))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := fmt.Sprintf("[%s] %d %s", "sender", i, padding)
+		for {
+			msg, err := receiver.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg == expected {
+				break
+			}
+			if !strings.HasPrefix(msg, "*") {
+				t.Fatalf("Expected message %d, got `%.40s...`", i, msg)
+			}
+			notices = append(notices, msg)
+		}
+	}
+
+	return notices
+}
+
+// Register a client with a small receive buffer which then stops reading
+func joinStalled(t *testing.T, addr string, name string) *client {
+	c := joinChat(t, addr, name)
+	c.Conn.(*net.TCPConn).SetReadBuffer(16 * 1024)
+	c.SetDeadline(time.Now().Add(time.Minute))
+	return c
+}
+
+func TestBroadcastDoesNotBlockOnStalledReaders(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		QueueSize:        16,
+		SlowClientPolicy: budgetchat.DisconnectSlowClient,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	addr := server.Addr().String()
+	stalled := []*client{}
+	for i := 0; i < 3; i++ {
+		c := joinStalled(t, addr, fmt.Sprintf("stalled%d", i))
+		defer c.Close()
+		stalled = append(stalled, c)
+	}
+
+	receiver := joinChat(t, addr, "receiver")
+	defer receiver.Close()
+	receiver.SetDeadline(time.Now().Add(time.Minute))
+	sender := joinChat(t, addr, "sender")
+	defer sender.Close()
+	expectMessages(t, receiver, "* sender has entered the room")
+
+	notices := floodRoom(t, sender, receiver, 5000)
+
+	// Evicted clients get some time to read the notice before they are
+	// disconnected, so their departure may only be announced later on.
+	left := map[string]bool{}
+	for _, n := range notices {
+		left[n] = true
+	}
+	for len(left) < len(stalled) {
+		msg, err := receiver.Recv()
+		if err != nil {
+			t.Fatalf("Expected all stalled clients to leave, only got %v: %s", left, err)
+		}
+		left[msg] = true
+	}
+
+	for i := range stalled {
+		expected := fmt.Sprintf("* stalled%d has left the room", i)
+		if !left[expected] {
+			t.Errorf("Expected stalled%d to be disconnected, got %v", i, left)
+		}
+	}
+}
+
+func TestSlowClientsCanMissMessages(t *testing.T) {
+	testCases := []struct {
+		name        string
+		policy      budgetchat.SlowClientPolicy
+		receiveLast bool
+	}{
+		{"drop oldest", budgetchat.DropOldestMessage, true},
+		{"drop newest", budgetchat.DropNewestMessage, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+				QueueSize:        16,
+				SlowClientPolicy: tc.policy,
+			})
+			if err != nil {
+				t.Fatalf("Failed to start server: %s\n", err)
+			}
+			defer server.Close()
+
+			addr := server.Addr().String()
+			stalled := joinStalled(t, addr, "stalled")
+			defer stalled.Close()
+			receiver := joinChat(t, addr, "receiver")
+			defer receiver.Close()
+			receiver.SetDeadline(time.Now().Add(time.Minute))
+			sender := joinChat(t, addr, "sender")
+			defer sender.Close()
+			expectMessages(t, receiver, "* sender has entered the room")
+
+			n := 5000
+			notices := floodRoom(t, sender, receiver, n)
+			if len(notices) != 0 {
+				t.Fatalf("Expected no client to be disconnected, got %v", notices)
+			}
+
+			// Catch up with everything the server still has for us
+			received := 0
+			last := ""
+			for {
+				stalled.SetDeadline(time.Now().Add(500 * time.Millisecond))
+				msg, err := stalled.Recv()
+				if err != nil || msg == "" {
+					break
+				}
+				if strings.HasPrefix(msg, "[sender]") {
+					received++
+					last = msg
+				}
+			}
+
+			if received >= n {
+				t.Errorf("Expected some messages to be dropped, got all %d", received)
+			}
+			gotLast := strings.HasPrefix(last, fmt.Sprintf("[sender] %d ", n-1))
+			if gotLast != tc.receiveLast {
+				t.Errorf("Expected receiving the last message to be %t, last was `%.40s`", tc.receiveLast, last)
+			}
+		})
+	}
+}
+
+func TestOnlyOneOfManyConcurrentUsersCanTakeAName(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	n := 50
+	results := make(chan string, n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			c, err := makeClient(server.Addr().String())
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			defer c.Close()
+
+			c.Recv()
+			c.Send("popular")
+			msg, _ := c.Recv()
+			results <- msg
+
+			// Hold on to the name until everyone has tried
+			time.Sleep(200 * time.Millisecond)
+		}()
+	}
+
+	joined := 0
+	for i := 0; i < n; i++ {
+		if strings.HasPrefix(<-results, "* The room contains") {
+			joined++
+		}
+	}
+
+	if joined != 1 {
+		t.Errorf("Expected exactly one client to get the name, got %d", joined)
+	}
+}
+
+func TestConcurrentJoinsLeavesAndMessages(t *testing.T) {
+	// Nobody reads until the end, so make sure no one gets evicted
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{QueueSize: 10000})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	addr := server.Addr().String()
+
+	observer := joinChat(t, addr, "observer")
+	defer observer.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c, err := makeClient(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			c.Recv()
+			c.Send(fmt.Sprintf("user%d", i))
+			for j := 0; j < 10; j++ {
+				c.Send(fmt.Sprintf("message %d", j))
+				if j%3 == 0 {
+					c.Send(fmt.Sprintf("/join room%d", j))
+				}
+				if j%5 == 0 {
+					c.Send("/leave")
+				}
+			}
+			c.Send("/quit")
+
+			// Wait to be disconnected
+			for {
+				msg, err := c.Recv()
+				if err != nil || msg == "" {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Everyone is gone, along with the rooms they created
+	observer.Send("/rooms")
+	for {
+		msg, err := observer.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(msg, "* Rooms:") {
+			if msg != "* Rooms: general (1)" {
+				t.Errorf("Expected only the observer to be left, got `%s`", msg)
+			}
+			break
+		}
+	}
+
+	// Leaving closes each user's outbox, so their writers don't stick around
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > goroutines {
+		t.Errorf("Expected %d goroutines after everyone left, got %d", goroutines, runtime.NumGoroutine())
+	}
+}
+
+func TestClosingTheServerDisconnectsClients(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	server.Close()
+
+	msg, err := alice.Recv()
+	if err != nil || msg != "" {
+		t.Fatalf("Expected to be disconnected, got `%s` (%v)", msg, err)
+	}
+}
+
+var historyEntryRegexp = regexp.MustCompile(`^\* \[\d{2}:\d{2}:\d{2}\] (.*)$`)
+
+// Receive n history entries, returning them without their timestamps
+func recvHistory(t *testing.T, c *client, n int) []string {
+	t.Helper()
+
+	entries := []string{}
+	for i := 0; i < n; i++ {
+		msg, err := c.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		match := historyEntryRegexp.FindStringSubmatch(msg)
+		if match == nil {
+			t.Fatalf("Expected a history entry, got `%s`", msg)
+		}
+		entries = append(entries, match[1])
+	}
+	return entries
+}
+
+func TestHistoryKeepsTheMostRecentMessages(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{HistorySize: 3})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	alice.Send("/history")
+	expectMessages(t, alice, "* Nothing has been said here yet")
+
+	for i := 0; i < 5; i++ {
+		alice.Send(fmt.Sprintf("message %d", i))
+	}
+	alice.Send("/me is done")
+
+	alice.Send("/history")
+	got := recvHistory(t, alice, 3)
+	expected := []string{"[alice] message 3", "[alice] message 4", "* alice is done"}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected history %v, got %v", expected, got)
+	}
+
+	alice.Send("/history 1")
+	got = recvHistory(t, alice, 1)
+	if got[0] != "* alice is done" {
+		t.Errorf("Expected only the last message, got %v", got)
+	}
+
+	alice.Send("/history zero")
+	expectMessages(t, alice, "* Usage: /history [n]")
+}
+
+func TestRecentMessagesAreReplayedOnJoin(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{ReplayOnJoin: 2})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	alice.Send("first")
+	alice.Send("second")
+	alice.Send("third")
+
+	// Make sure the messages went through before bob joins
+	alice.Send("/history 1")
+	recvHistory(t, alice, 1)
+
+	// The list of users is followed by the replay
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	got := recvHistory(t, bob, 2)
+	expected := []string{"[alice] second", "[alice] third"}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected replay %v, got %v", expected, got)
+	}
+
+	// History is kept per room
+	bob.Send("/join quiet")
+	expectMessages(t, bob, "* The room contains: ")
+	bob.Send("/history")
+	expectMessages(t, bob, "* Nothing has been said here yet")
+}
+
+func TestHistoryCanBeDisabled(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		HistorySize:  -1,
+		ReplayOnJoin: 5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	alice.Send("hello")
+
+	alice.Send("/history")
+	expectMessages(t, alice, "* Nothing has been said here yet")
+
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	bob.Send("/who")
+	expectMessages(t, bob, "* The room contains: alice, bob")
+}
+
+func TestNegativeReplayIsIgnored(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{ReplayOnJoin: -1})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	alice.Send("hello")
+
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	bob.Send("/who")
+	expectMessages(t, bob, "* The room contains: alice, bob")
+}
+
+func TestTranscriptRecordsRoomEvents(t *testing.T) {
+	dir := t.TempDir()
+	transcript, err := budgetchat.OpenTranscriptLog(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transcript.Close()
+
+	start := time.Now()
+
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{Transcript: transcript})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+
+	alice.Send("Hello Bob")
+	expectMessages(t, bob, "[alice] Hello Bob")
+	bob.Send("/msg alice this is private")
+	bob.Send("/join elsewhere")
+	expectMessages(t, bob, "* The room contains: ")
+	bob.Send("/quit")
+	expectMessages(t, alice, "* bob has entered the room", "[bob -> alice] this is private", "* bob has left the room")
+
+	// bob leaves the second room once the server notices the disconnection
+	var events []budgetchat.TranscriptEvent
+	deadline := time.Now().Add(time.Second)
+	for len(events) < 6 && time.Now().Before(deadline) {
+		events, err = budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"join general alice ",
+		"join general bob ",
+		"message general alice [alice] Hello Bob",
+		"leave general bob ",
+		"join elsewhere bob ",
+		"leave elsewhere bob ",
+	}
+	got := []string{}
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %s %s %s", e.Type, e.Room, e.User, e.Text))
+		if e.Time.Before(start) || e.Time.After(time.Now()) {
+			t.Errorf("Unexpected time for event %+v", e)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	// Filters
+	events, _ = budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{User: "bob"})
+	if len(events) != 4 {
+		t.Errorf("Expected 4 events for bob, got %d", len(events))
+	}
+	events, _ = budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{Text: "hello"})
+	if len(events) != 1 || events[0].User != "alice" {
+		t.Errorf("Expected to find alice's message, got %+v", events)
+	}
+	events, _ = budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{Until: start})
+	if len(events) != 0 {
+		t.Errorf("Expected no events before the server started, got %+v", events)
+	}
+}
+
+func TestTranscriptLogRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each event takes about 100 bytes
+	transcript, err := budgetchat.OpenTranscriptLog(dir, 250, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(l *budgetchat.TranscriptLog, i int) {
+		err := l.Record(budgetchat.TranscriptEvent{
+			Time: time.Now(),
+			Type: budgetchat.TRANSCRIPT_MESSAGE,
+			Room: "general",
+			User: "alice",
+			Text: fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		record(transcript, i)
+	}
+	transcript.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files to be kept, got %v", files)
+	}
+
+	// Reopening carries on with the latest file
+	transcript, err = budgetchat.OpenTranscriptLog(dir, 250, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(transcript, 10)
+	transcript.Close()
+
+	// A partially written line is skipped
+	f, _ := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"time":"2023-`)
+	f.Close()
+
+	events, err := budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[len(events)-1].Text != "message 10" {
+		t.Fatalf("Expected the last event to be message 10, got %+v", events)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("Expected events in order, got %+v", events)
+		}
+	}
+	if len(events) >= 11 {
+		t.Errorf("Expected the oldest events to be gone, got %d", len(events))
+	}
+}
+
+func TestTranscriptLogKeepsGoingWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	transcript, err := budgetchat.OpenTranscriptLog(dir, 250, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transcript.Close()
+
+	record := func(i int) {
+		err := transcript.Record(budgetchat.TranscriptEvent{
+			Time: time.Now(),
+			Type: budgetchat.TRANSCRIPT_MESSAGE,
+			Room: "general",
+			User: "alice",
+			Text: fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := func(name string) int {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return strings.Count(string(data), "\n")
+	}
+
+	// The next file can't be created while there's a directory in its way
+	next := filepath.Join(dir, "transcript-000002.jsonl")
+	if err := os.Mkdir(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		record(i)
+	}
+	deadline := time.Now().Add(time.Second)
+	for lines("transcript-000001.jsonl") < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := lines("transcript-000001.jsonl"); n != 5 {
+		t.Fatalf("Expected the current file to take every event, got %d", n)
+	}
+
+	// Rotating is tried again with the next event
+	os.Remove(next)
+	record(5)
+	transcript.Close()
+
+	events, err := budgetchat.SearchTranscripts(dir, budgetchat.TranscriptFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 || lines("transcript-000002.jsonl") != 1 {
+		t.Errorf("Expected the last event to start a new file, got %+v", events)
+	}
+}
+
+func TestAdminLogin(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{AdminSecret: "hunter2"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	for _, login := range []string{"mallory guess", "mallory hunter2 extra"} {
+		c, err := makeClient(server.Addr().String())
+		if err != nil {
+			t.Fatalf("Error constructing client: %s", err)
+		}
+		defer c.Close()
+
+		c.Recv()
+		c.Send(login)
+		expectMessages(t, c, "* Invalid admin secret, disconnecting!")
+	}
+
+	admin := joinChat(t, server.Addr().String(), "admin hunter2")
+	defer admin.Close()
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	expectMessages(t, admin, "* alice has entered the room")
+
+	// Moderation commands are hidden from everyone else
+	alice.Send("/kick admin")
+	expectMessages(t, admin, "[alice] /kick admin")
+
+	admin.Send("/kick alice Be nice")
+	expectMessages(t, alice, "* You have been kicked by admin: Be nice")
+	expectMessages(t, admin, "* alice has been disconnected", "* alice has left the room")
+
+	msg, err := alice.Recv()
+	if err != nil || msg != "" {
+		t.Fatalf("Expected to be disconnected, got `%s` (%v)", msg, err)
+	}
+}
+
+func TestBans(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{AdminSecret: "hunter2"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	addr := server.Addr().String()
+	admin := joinChat(t, addr, "admin hunter2")
+	defer admin.Close()
+
+	assertBanned := func(login string) {
+		t.Helper()
+		c, err := makeClient(addr)
+		if err != nil {
+			t.Fatalf("Error constructing client: %s", err)
+		}
+		defer c.Close()
+		c.Recv()
+		c.Send(login)
+		expectMessages(t, c, "* You are banned, disconnecting!")
+	}
+
+	// Names can be banned ahead of time
+	admin.Send("/ban troll 50ms")
+	expectMessages(t, admin, "* troll is banned for 50ms")
+	assertBanned("troll")
+	time.Sleep(100 * time.Millisecond)
+	troll := joinChat(t, addr, "troll")
+	expectMessages(t, admin, "* troll has entered the room")
+
+	// Banning a user that's present kicks them, but leaves alone everyone
+	// else sharing their address
+	admin.Send("/ban troll")
+	expectMessages(t, troll, "* You have been banned, disconnecting!")
+	expectMessages(t, admin, "* troll has been disconnected", "* troll is banned for 1h0m0s", "* troll has left the room")
+	troll.Close()
+	assertBanned("troll")
+	other := joinChat(t, addr, "other")
+	expectMessages(t, admin, "* other has entered the room")
+
+	// Addresses have to be banned explicitly, which never kicks the admin
+	// banning them
+	admin.Send("/ban 127.0.0.1")
+	expectMessages(t, other, "* You have been banned, disconnecting!")
+	expectMessages(t, admin, "* other has been disconnected", "* 127.0.0.1 is banned for 1h0m0s", "* other has left the room")
+	other.Close()
+	assertBanned("other")
+	admin.Send("/who")
+	expectMessages(t, admin, "* The room contains: admin")
+
+	admin.Send("/unban 127.0.0.1")
+	expectMessages(t, admin, "* 127.0.0.1 is no longer banned")
+	other = joinChat(t, addr, "other")
+	defer other.Close()
+	assertBanned("troll")
+
+	admin.Send("/unban troll")
+	expectMessages(t, admin, "* other has entered the room", "* troll is no longer banned")
+	troll = joinChat(t, addr, "troll")
+	defer troll.Close()
+
+	admin.Send("/ban troll soon")
+	expectMessages(t, admin, "* troll has entered the room", "* Invalid duration: soon")
+}
+
+func TestMutes(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{AdminSecret: "hunter2"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	admin := joinChat(t, server.Addr().String(), "admin hunter2")
+	defer admin.Close()
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	expectMessages(t, admin, "* alice has entered the room")
+
+	admin.Send("/mute alice")
+	expectMessages(t, alice, "* You have been muted for 10m0s")
+	expectMessages(t, admin, "* alice is muted for 10m0s")
+
+	alice.Send("can anyone hear me?")
+	alice.Send("/me shouts")
+	alice.Send("/msg admin please")
+	alice.Send("/away listen to me")
+	// Changing names doesn't help
+	alice.Send("/nick alicia")
+	alice.Send("hello?")
+	expectMessages(t, alice,
+		"* You are muted",
+		"* You are muted",
+		"* You are muted",
+		"* You are muted",
+		"* alice is now known as alicia",
+		"* You are muted",
+	)
+
+	admin.Send("/unmute alicia")
+	expectMessages(t, alice, "* You are no longer muted")
+	alice.Send("thanks")
+	expectMessages(t, admin, "* alice is now known as alicia", "* alicia is no longer muted", "[alicia] thanks")
+}
+
+func TestBannedWordsAreFiltered(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{BannedWords: []string{"darn", "heck"}})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+
+	alice.Send("Darn it, what the heck")
+	alice.Send("/me checks the darnedest thing")
+	expectMessages(t, bob, "[alice] **** it, what the ****", "* alice checks the darnedest thing")
+}
+
+func TestRateLimitWarnsThenDisconnects(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		MessageRate:  1,
+		MessageBurst: 3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	spammer := joinChat(t, server.Addr().String(), "spammer")
+	defer spammer.Close()
+
+	for i := 0; i < 5; i++ {
+		spammer.Send(fmt.Sprintf("spam %d", i))
+	}
+	expectMessages(t, spammer,
+		"* You are sending messages too quickly, slow down!",
+		"* You were warned, disconnecting!",
+	)
+
+	msg, err := spammer.Recv()
+	if err != nil || msg != "" {
+		t.Fatalf("Expected to be disconnected, got `%s` (%v)", msg, err)
+	}
+}
+
+// Try to register and return the server's response
+func tryName(t *testing.T, addr string, name string) (*client, string) {
+	t.Helper()
+
+	c, err := makeClient(addr)
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	c.Recv()
+	c.Send(name)
+	msg, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, msg
+}
+
+func TestNamePolicy(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		NamePolicy: budgetchat.NamePolicy{
+			MaxLength:       8,
+			ExtraCharacters: "_",
+			Reserved:        []string{"server"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	addr := server.Addr().String()
+	alice := joinChat(t, addr, "alice")
+	defer alice.Close()
+
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{"waytoolong", "* Name is too long, disconnecting!"},
+		{"Server", "* Name is reserved, disconnecting!"},
+		{"ALICE", "* Name already in use, disconnecting!"},
+		{"中文名字", "* Illegal name, disconnecting!"},
+		{"a-b", "* Illegal name, disconnecting!"},
+		{"with_und", "* The room contains: alice"},
+	}
+
+	for _, tc := range testCases {
+		c, msg := tryName(t, addr, tc.name)
+		defer c.Close()
+		if msg != tc.expected {
+			t.Errorf("Expected `%s` for name `%s`, got `%s`", tc.expected, tc.name, msg)
+		}
+	}
+
+	// Renames follow the same rules, but users can change the case of their
+	// own names
+	alice.Send("/nick WITH_UND")
+	alice.Send("/nick SERVER")
+	alice.Send("/nick Alice")
+	expectMessages(t, alice,
+		"* with_und has entered the room",
+		"* Name already in use",
+		"* Name is reserved",
+		"* alice is now known as Alice",
+	)
+
+	// Other users can be addressed regardless of case
+	alice.Send("/msg With_Und hi")
+	c, _ := tryName(t, addr, "bob")
+	defer c.Close()
+	c.Send("/msg alice hi")
+	expectMessages(t, alice, "* bob has entered the room", "[bob -> Alice] hi")
+}
+
+func TestCaseSensitiveNames(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		NamePolicy: budgetchat.NamePolicy{CaseSensitive: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	other := joinChat(t, server.Addr().String(), "Alice")
+	defer other.Close()
+}
+
+func TestUnicodeNames(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		NamePolicy: budgetchat.NamePolicy{AllowUnicode: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	addr := server.Addr().String()
+
+	// Composed form
+	jose := joinChat(t, addr, "Jos\u00e9")
+	defer jose.Close()
+	chinese := joinChat(t, addr, "中文名字")
+	defer chinese.Close()
+	alice := joinChat(t, addr, "alice")
+	defer alice.Close()
+
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		// Decomposed form of the same name
+		{"Jose\u0301", "* Name already in use, disconnecting!"},
+		// Without the accent
+		{"jose", "* Name already in use, disconnecting!"},
+		// Cyrillic а
+		{"\u0430lice", "* Name already in use, disconnecting!"},
+		// Full-width letters
+		{"\uff41lice", "* Name already in use, disconnecting!"},
+		{"\u0301abc", "* Illegal name, disconnecting!"},
+		{"a.b", "* Illegal name, disconnecting!"},
+	}
+
+	for _, tc := range testCases {
+		c, msg := tryName(t, addr, tc.name)
+		defer c.Close()
+		if msg != tc.expected {
+			t.Errorf("Expected `%s` for name %q, got `%s`", tc.expected, tc.name, msg)
+		}
+	}
+
+	// Names are shown normalized
+	decomposed := joinChat(t, addr, "Rene\u0301")
+	defer decomposed.Close()
+	expectMessages(t, alice, "* Ren\u00e9 has entered the room")
+}
+
+func TestWebSocketAndTCPClientsShareTheRoom(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{WebSocketAddress: "localhost:"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	wsAddr := server.(interface{ WebSocketAddr() net.Addr }).WebSocketAddr()
+	url := fmt.Sprintf("ws://%s%s", wsAddr, budgetchat.WEBSOCKET_PATH)
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error establishing a WebSocket connection: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	expectWS := func(expected ...string) {
+		t.Helper()
+		for _, e := range expected {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != websocket.TextMessage || string(data) != e {
+				t.Fatalf("Expected to receive `%s`, got `%s`", e, data)
+			}
+		}
+	}
+
+	expectWS("Welcome to budgetchat! What shall I call you?")
+	ws.WriteMessage(websocket.TextMessage, []byte("bob"))
+	expectWS("* The room contains: alice")
+	expectMessages(t, alice, "* bob has entered the room")
+
+	ws.WriteMessage(websocket.TextMessage, []byte("hi from the browser"))
+	expectMessages(t, alice, "[bob] hi from the browser")
+
+	alice.Send("hi from the terminal")
+	expectWS("[alice] hi from the terminal")
+
+	ws.WriteMessage(websocket.TextMessage, []byte("/who"))
+	expectWS("* The room contains: alice, bob")
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	expectMessages(t, alice, "* bob has left the room")
+}
+
+func TestStalledWebSocketClientsAreDisconnected(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		QueueSize:        16,
+		SlowClientPolicy: budgetchat.DisconnectSlowClient,
+		WebSocketAddress: "localhost:",
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	wsAddr := server.(interface{ WebSocketAddr() net.Addr }).WebSocketAddr()
+	url := fmt.Sprintf("ws://%s%s", wsAddr, budgetchat.WEBSOCKET_PATH)
+
+	// A client with a small receive buffer which stops reading once joined
+	dialer := websocket.Dialer{NetDial: func(network string, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.(*net.TCPConn).SetReadBuffer(16 * 1024)
+		}
+		return conn, err
+	}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error establishing a WebSocket connection: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ws.ReadMessage()
+	ws.WriteMessage(websocket.TextMessage, []byte("stalled"))
+	ws.ReadMessage()
+
+	addr := server.Addr().String()
+	receiver := joinChat(t, addr, "receiver")
+	defer receiver.Close()
+	receiver.SetDeadline(time.Now().Add(time.Minute))
+	sender := joinChat(t, addr, "sender")
+	defer sender.Close()
+	expectMessages(t, receiver, "* sender has entered the room")
+
+	left := false
+	for _, n := range floodRoom(t, sender, receiver, 5000) {
+		left = left || n == "* stalled has left the room"
+	}
+	for !left {
+		msg, err := receiver.Recv()
+		if err != nil {
+			t.Fatalf("Expected the stalled client to leave: %s", err)
+		}
+		left = msg == "* stalled has left the room"
+	}
+
+	// The name is free again
+	again := joinChat(t, addr, "stalled")
+	defer again.Close()
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		WebSocketAddress: "localhost:",
+		WebSocketOrigins: []string{"https://chat.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	wsAddr := server.(interface{ WebSocketAddr() net.Addr }).WebSocketAddr()
+	url := fmt.Sprintf("ws://%s%s", wsAddr, budgetchat.WEBSOCKET_PATH)
+
+	// Only pages from the given origins can connect
+	_, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil {
+		t.Errorf("Expected a page from another origin to be turned away")
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://chat.example.com"}})
+	if err != nil {
+		t.Fatalf("Error establishing a WebSocket connection: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ws.ReadMessage()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte("bob"))
+	expectMessages(t, alice, "* bob has entered the room")
+
+	// Messages are held to the same limit as lines from TCP clients
+	ws.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("a"), budgetchat.MAX_LINE_SIZE+1))
+	expectMessages(t, alice, "* bob has left the room")
+}
+
+func TestWebSocketIsDisabledByDefault(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	if addr := server.(interface{ WebSocketAddr() net.Addr }).WebSocketAddr(); addr != nil {
+		t.Errorf("Expected no WebSocket listener, got one on %s", addr)
+	}
+}
+
+func TestIRCAndTCPClientsShareTheRoom(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{IRCAddress: "localhost:"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	ircAddr := server.(interface{ IRCAddr() net.Addr }).IRCAddr()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	irc, err := makeClient(ircAddr.String())
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	defer irc.Close()
+
+	irc.Send("NICK bob")
+	irc.Send("USER bob 0 * :Bob")
+	expectMessages(t, irc,
+		":budgetchat 001 bob :Welcome to budgetchat, bob",
+		":bob JOIN #general",
+		":budgetchat 353 bob = #general :alice bob",
+		":budgetchat 366 bob #general :End of /NAMES list",
+	)
+	expectMessages(t, alice, "* bob has entered the room")
+
+	irc.Send("PING :12345")
+	expectMessages(t, irc, ":budgetchat PONG budgetchat :12345")
+
+	irc.Send("PRIVMSG #general :hi from irc")
+	expectMessages(t, alice, "[bob] hi from irc")
+	alice.Send("hi from tcp")
+	expectMessages(t, irc, ":alice PRIVMSG #general :hi from tcp")
+
+	irc.Send("PRIVMSG alice :psst")
+	expectMessages(t, alice, "[bob -> alice] psst")
+	alice.Send("/msg bob hey")
+	expectMessages(t, irc, ":alice PRIVMSG bob :hey")
+
+	irc.Send("PRIVMSG #general :\x01ACTION waves\x01")
+	expectMessages(t, alice, "* bob waves")
+
+	// Chat commands are only ever what IRC clients say
+	irc.Send("PRIVMSG #general :/nick mallory")
+	expectMessages(t, alice, "[bob] /nick mallory")
+
+	irc.Send("NAMES #general")
+	expectMessages(t, irc,
+		":budgetchat 353 bob = #general :alice bob",
+		":budgetchat 366 bob #general :End of /NAMES list",
+	)
+
+	irc.Send("JOIN #lobby")
+	expectMessages(t, irc,
+		":bob PART #general",
+		":bob JOIN #lobby",
+		":budgetchat 353 bob = #lobby :bob",
+		":budgetchat 366 bob #lobby :End of /NAMES list",
+	)
+	expectMessages(t, alice, "* bob has left the room")
+
+	alice.Send("/join lobby")
+	expectMessages(t, alice, "* The room contains: bob")
+	expectMessages(t, irc, ":alice JOIN #lobby")
+
+	irc.Send("PART #lobby")
+	expectMessages(t, irc,
+		":bob PART #lobby",
+		":bob JOIN #general",
+		":budgetchat 353 bob = #general :bob",
+		":budgetchat 366 bob #general :End of /NAMES list",
+	)
+	expectMessages(t, alice, "* bob has left the room")
+
+	alice.Send("/leave")
+	expectMessages(t, alice, "* The room contains: bob")
+	expectMessages(t, irc, ":alice JOIN #general")
+
+	irc.Send("QUIT :bye")
+	expectMessages(t, alice, "* bob has left the room")
+}
+
+func TestIRCClientsCannotBeFooledByWhatUsersSay(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{IRCAddress: "localhost:"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	the := joinChat(t, server.Addr().String(), "The")
+	defer the.Close()
+
+	irc, err := makeClient(server.(interface{ IRCAddr() net.Addr }).IRCAddr().String())
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	defer irc.Close()
+
+	irc.Send("NICK bob")
+	irc.Send("USER bob 0 * :Bob")
+	expectMessages(t, irc,
+		":budgetchat 001 bob :Welcome to budgetchat, bob",
+		":bob JOIN #general",
+		":budgetchat 353 bob = #general :The bob",
+		":budgetchat 366 bob #general :End of /NAMES list",
+	)
+	expectMessages(t, the, "* bob has entered the room")
+
+	the.Send("/me has left the room")
+	the.Send("/me is now known as bob")
+	the.Send("-> bob] hi")
+	the.Send("/me room contains: mallory")
+	expectMessages(t, irc,
+		":The PRIVMSG #general :\x01ACTION has left the room\x01",
+		":The PRIVMSG #general :\x01ACTION is now known as bob\x01",
+		":The PRIVMSG #general :-> bob] hi",
+		":The PRIVMSG #general :\x01ACTION room contains: mallory\x01",
+	)
+
+	// Listings still go where they belong
+	irc.Send("JOIN #lobby")
+	expectMessages(t, irc,
+		":bob PART #general",
+		":bob JOIN #lobby",
+		":budgetchat 353 bob = #lobby :bob",
+		":budgetchat 366 bob #lobby :End of /NAMES list",
+	)
+}
+
+func TestIRCLinesAreLimited(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{IRCAddress: "localhost:"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	irc, err := makeClient(server.(interface{ IRCAddr() net.Addr }).IRCAddr().String())
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	defer irc.Close()
+	irc.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// A line that never ends gets the client disconnected
+	_, err = irc.Write(bytes.Repeat([]byte("a"), budgetchat.MAX_LINE_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Depending on timing, the connection is either closed or reset
+	msg, err := irc.Recv()
+	if timeout, ok := err.(net.Error); msg != "" || (ok && timeout.Timeout()) {
+		t.Errorf("Expected to be disconnected, got `%s` (%v)", msg, err)
+	}
+}
+
+func TestIRCNicknamesFollowTheNamePolicy(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{IRCAddress: "localhost:"})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+
+	irc, err := makeClient(server.(interface{ IRCAddr() net.Addr }).IRCAddr().String())
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+	defer irc.Close()
+
+	irc.Send("NICK alice")
+	irc.Send("USER alice 0 * :Alice")
+	expectMessages(t, irc, "ERROR :Name already in use, disconnecting!")
+}
+
+func TestAwayStatus(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		ShowStatus:  true,
+		AdminSecret: "hunter2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	expectMessages(t, alice, "* bob has entered the room")
+
+	bob.Send("/away lunch")
+	expectMessages(t, bob, "* You are marked as away")
+	expectMessages(t, alice, "* bob is away: lunch")
+
+	alice.Send("/who")
+	expectMessages(t, alice, "* The room contains: alice, bob (away)")
+
+	alice.Send("/msg bob are you there?")
+	expectMessages(t, bob, "[alice -> bob] are you there?")
+	expectMessages(t, alice, "* bob is away: lunch")
+
+	alice.Send("/whois bob")
+	msg, _ := alice.Recv()
+	if !regexp.MustCompile(`^\* bob is in general, connected for \d+s, idle for \d+s, away: lunch$`).MatchString(msg) {
+		t.Errorf("Unexpected /whois reply: %s", msg)
+	}
+
+	// Admins can also see where users connect from
+	admin := joinChat(t, server.Addr().String(), "carol hunter2")
+	defer admin.Close()
+	expectMessages(t, alice, "* carol has entered the room")
+	admin.Send("/whois bob")
+	msg, _ = admin.Recv()
+	assertServerMessage(t, msg, "from 127.0.0.1:")
+
+	bob.Send("/away")
+	expectMessages(t, bob, "* carol has entered the room", "* You are no longer marked as away")
+	expectMessages(t, alice, "* bob is back")
+	bob.Send("/away")
+	expectMessages(t, bob, "* You are not away")
+}
+
+func TestIdleUsersAreAnnounced(t *testing.T) {
+	server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+		IdleTimeout: 200 * time.Millisecond,
+		ShowStatus:  true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, server.Addr().String(), "bob")
+	defer bob.Close()
+	expectMessages(t, alice, "* bob has entered the room")
+
+	expectMessages(t, alice, "* bob is idle")
+	alice.Send("/who")
+	expectMessages(t, alice, "* The room contains: alice, bob (idle)")
+
+	bob.Send("back")
+	expectMessages(t, alice, "* bob is no longer idle", "[bob] back")
+}
+
+func TestBotsTakePartInRooms(t *testing.T) {
+	server, err := budgetchat.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	bots := server.(interface {
+		AddBot(name string, room string, bot budgetchat.Bot) error
+	})
+	if err := bots.AddBot("greeter", "general", budgetchat.NewWelcomeBot("Welcome!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bots.AddBot("dice", "general", budgetchat.NewDiceBot()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bots.AddBot("reminder", "general", budgetchat.NewReminderBot()); err != nil {
+		t.Fatal(err)
+	}
+	echo := budgetchat.BotFunc(func(s *budgetchat.BotSession, e budgetchat.BotEvent) {
+		if e.Type == budgetchat.BOT_MESSAGE {
+			s.Say("echo: " + e.Text)
+		}
+	})
+	if err := bots.AddBot("echo", "lobby", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := bots.AddBot("Dice", "lobby", echo); err == nil {
+		t.Errorf("Expected bot names to be unique")
+	}
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	expectMessages(t, alice, "[greeter -> alice] Welcome!")
+
+	alice.Send("/who")
+	expectMessages(t, alice, "* The room contains: alice, dice, greeter, reminder")
+
+	alice.Send("!roll 2d6")
+	msg, _ := alice.Recv()
+	if !regexp.MustCompile(`^\[dice\] alice rolled 2d6: [1-6], [1-6] \(total \d+\)$`).MatchString(msg) {
+		t.Errorf("Unexpected roll: %s", msg)
+	}
+
+	alice.Send("/msg reminder !remind 50ms stretch")
+	expectMessages(t, alice,
+		"[reminder -> alice] I'll remind you in 50ms",
+		"[reminder -> alice] Reminder: stretch",
+	)
+
+	// Bot names are taken like any other
+	impostor, msg := tryName(t, server.Addr().String(), "dice")
+	defer impostor.Close()
+	assertServerMessage(t, msg, "in use")
+
+	// Rooms with bots in them stay around
+	alice.Send("/rooms")
+	expectMessages(t, alice, "* Rooms: general (4), lobby (1)")
+	alice.Send("/join lobby")
+	expectMessages(t, alice, "* The room contains: echo")
+	alice.Send("anyone here?")
+	expectMessages(t, alice, "[echo] echo: anyone here?")
+}
+
+// Start a server with two bots answering each other forever
+func startPingPong(t *testing.T, opts budgetchat.Options) protos.Server {
+	server, err := budgetchat.ServeWithOptions("localhost:", opts)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+
+	bots := server.(interface {
+		AddBot(name string, room string, bot budgetchat.Bot) error
+	})
+	for _, name := range []string{"ping", "pong"} {
+		bot := budgetchat.BotFunc(func(s *budgetchat.BotSession, e budgetchat.BotEvent) {
+			if e.Type == budgetchat.BOT_MESSAGE {
+				s.Say(s.Name())
+			}
+		})
+		if err := bots.AddBot(name, "general", bot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func TestBotsFollowTheRules(t *testing.T) {
+	// Nothing holds back bots answering each other, so there's more to read
+	// than the admin can keep up with
+	server := startPingPong(t, budgetchat.Options{
+		AdminSecret:      "hunter2",
+		SlowClientPolicy: budgetchat.DropOldestMessage,
+	})
+	defer server.Close()
+
+	admin := joinChat(t, server.Addr().String(), "admin hunter2")
+	defer admin.Close()
+
+	// Set the bots off and leave them to it
+	admin.Send("go")
+	admin.Send("/join lobby")
+	for {
+		msg, err := admin.Recv()
+		if err != nil || msg == "" {
+			t.Fatalf("Expected to get to the lobby, got %v", err)
+		}
+		if msg == "* The room contains: " {
+			break
+		}
+	}
+
+	// They don't hold up anyone else, and can be dealt with like users
+	admin.Send("/mute ping")
+	expectMessages(t, admin, "* ping is muted for 10m0s")
+	admin.Send("/kick pong")
+	expectMessages(t, admin, "* pong has been removed")
+	admin.Send("/rooms")
+	expectMessages(t, admin, "* Rooms: general (1), lobby (1)")
+
+	admin.Send("/join general")
+	expectMessages(t, admin, "* The room contains: ping")
+	admin.Send("anyone?")
+	admin.Send("/who")
+	expectMessages(t, admin, "* The room contains: admin, ping")
+}
+
+func TestBotsAreRateLimited(t *testing.T) {
+	server := startPingPong(t, budgetchat.Options{MessageRate: 0.1, MessageBurst: 3})
+	defer server.Close()
+
+	alice := joinChat(t, server.Addr().String(), "alice")
+	defer alice.Close()
+	alice.Send("go")
+	alice.Send("/who")
+
+	// Each bot gets its burst, and then it's over
+	said := map[string]int{}
+	for {
+		msg, err := alice.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(msg, "* The room contains: ") {
+			break
+		}
+		said[msg]++
+	}
+	alice.Send("/who")
+	expectMessages(t, alice, "* The room contains: alice, ping, pong")
+
+	if said["[ping] ping"] != 3 || said["[pong] pong"] != 3 || len(said) != 2 {
+		t.Errorf("Expected each bot to say 3 things, got %v", said)
+	}
+}
+
+// Start servers linked to each other on loopback, each one dialing the ones
+// started before it
+func startFederation(t *testing.T, names ...string) []protos.Server {
+	servers := []protos.Server{}
+	peers := []string{}
+	for _, name := range names {
+		server, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{
+			ServerName:  name,
+			PeerSecret:  "secret",
+			PeerAddress: "localhost:",
+			Peers:       append([]string{}, peers...),
+		})
+		if err != nil {
+			t.Fatalf("Failed to start server: %s\n", err)
+		}
+		servers = append(servers, server)
+		peers = append(peers, server.(interface{ PeerAddr() net.Addr }).PeerAddr().String())
+	}
+	return servers
+}
+
+// Ask for the list of users in the room until it matches, since links
+// between servers come up in the background. Everything received before that
+// is discarded.
+func waitForMembers(t *testing.T, c *client, members string) {
+	t.Helper()
+
+	expected := "* The room contains: " + members
+	for i := 0; i < 50; i++ {
+		c.Send("/who")
+		for {
+			msg, err := c.Recv()
+			if err != nil {
+				t.Fatalf("Expected to receive `%s`, got error: %s", expected, err)
+			}
+			if msg == expected {
+				return
+			}
+			if strings.HasPrefix(msg, "* The room contains: ") {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Room never contained %s", members)
+}
+
+func TestFederatedServersShareRooms(t *testing.T) {
+	servers := startFederation(t, "a", "b", "c")
+	for _, server := range servers {
+		defer server.Close()
+	}
+
+	alice := joinChat(t, servers[0].Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, servers[1].Addr().String(), "bob")
+	defer bob.Close()
+	carol := joinChat(t, servers[2].Addr().String(), "carol")
+	defer carol.Close()
+
+	waitForMembers(t, alice, "alice, bob, carol")
+	waitForMembers(t, bob, "alice, bob, carol")
+	waitForMembers(t, carol, "alice, bob, carol")
+
+	alice.Send("hello everyone")
+	expectMessages(t, bob, "[alice] hello everyone")
+	expectMessages(t, carol, "[alice] hello everyone")
+	bob.Send("/me waves")
+	expectMessages(t, alice, "* bob waves")
+	expectMessages(t, carol, "* bob waves")
+
+	carol.Send("/msg bob psst")
+	expectMessages(t, bob, "[carol -> bob] psst")
+
+	// Names are unique across the federation
+	impostor, msg := tryName(t, servers[2].Addr().String(), "Bob")
+	defer impostor.Close()
+	assertServerMessage(t, msg, "in use")
+	alice.Send("/nick bob")
+	expectMessages(t, alice, "* Name already in use")
+
+	// Rooms span servers too
+	bob.Send("/join lobby")
+	expectMessages(t, bob, "* The room contains: ")
+	expectMessages(t, alice, "* bob has left the room")
+	expectMessages(t, carol, "* bob has left the room")
+	carol.Send("/join lobby")
+	expectMessages(t, carol, "* The room contains: bob")
+	expectMessages(t, bob, "* carol has entered the room")
+
+	carol.Send("/nick carla")
+	expectMessages(t, bob, "* carol is now known as carla")
+	bob.Send("/rooms")
+	expectMessages(t, bob, "* Rooms: general (1), lobby (2)")
+
+	carol.Close()
+	expectMessages(t, bob, "* carla has left the room")
+}
+
+func TestUsersLeaveWithTheirServer(t *testing.T) {
+	servers := startFederation(t, "a", "b")
+	defer servers[0].Close()
+
+	alice := joinChat(t, servers[0].Addr().String(), "alice")
+	defer alice.Close()
+	bob := joinChat(t, servers[1].Addr().String(), "bob")
+	defer bob.Close()
+	waitForMembers(t, alice, "alice, bob")
+
+	servers[1].Close()
+	expectMessages(t, alice, "* bob has left the room")
+
+	// The name is free again
+	bob = joinChat(t, servers[0].Addr().String(), "bob")
+	defer bob.Close()
+}
+
+func TestLinkingServersTakesTheSecret(t *testing.T) {
+	_, err := budgetchat.ServeWithOptions("localhost:", budgetchat.Options{PeerAddress: "localhost:"})
+	if err == nil {
+		t.Fatalf("Expected linking servers without a secret to be refused")
+	}
+
+	servers := startFederation(t, "b")
+	defer servers[0].Close()
+	alice := joinChat(t, servers[0].Addr().String(), "alice")
+	defer alice.Close()
+
+	link := func(secret string, events ...string) {
+		conn, err := net.Dial("tcp", servers[0].(interface{ PeerAddr() net.Addr }).PeerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, `{"type":"hello","server":"a","secret":"%s"}`+"\n", secret)
+		for _, e := range events {
+			fmt.Fprintln(conn, e)
+		}
+		// Wait for the server to hang up, or to have gone through everything
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		io.Copy(io.Discard, conn)
+	}
+
+	// Without the secret, nothing gets through
+	link("wrong", `{"type":"join","user":"alice","room":"general"}`)
+	alice.Send("/who")
+	expectMessages(t, alice, "* The room contains: alice")
+
+	// Messages can't span lines
+	link("secret",
+		`{"type":"join","user":"mallory","room":"general"}`,
+		`{"type":"message","user":"mallory","room":"general","text":"hi\n* alice has left the room"}`,
+	)
+	expectMessages(t, alice, "* mallory has entered the room", "* mallory has left the room")
+
+	// And are shown as said by whoever sent them
+	link("secret",
+		`{"type":"join","user":"mallory","room":"general"}`,
+		`{"type":"message","user":"mallory","room":"general","text":"* alice has left the room"}`,
+	)
+	expectMessages(t, alice,
+		"* mallory has entered the room",
+		"[mallory] * alice has left the room",
+		"* mallory has left the room",
+	)
+}
+
+// Assert that the message is a message sent server (starts with `*`) and contains the
+// expected strings
+func assertServerMessage(t *testing.T, m string, expected ...string) {
+	if !strings.HasPrefix(m, "*") {
+		t.Fatalf("%s does not start with character `*`", m)
+	}
+
+	for _, s := range expected {
+		if !strings.Contains(m, s) {
+			t.Fatalf("%s does not contain expected substring %s", m, s)
+		}
+	}
+}
+
+// Connect to the server and register with the given name, consuming the
+// welcome prompt and the list of users present in the room.
+func joinChat(t *testing.T, addr string, name string) *client {
+	c, err := makeClient(addr)
+	if err != nil {
+		t.Fatalf("Error constructing client: %s", err)
+	}
+
+	_, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Send(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertServerMessage(t, msg)
+
+	return c
+}
+
+// Assert that the next messages received by the client are exactly the given ones
+func expectMessages(t *testing.T, c *client, expected ...string) {
+	t.Helper()
+
+	for _, e := range expected {
+		msg, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Expected to receive `%s`, got error: %s", e, err)
+		}
+		if msg != e {
+			t.Fatalf("Expected to receive `%s`, got `%s` instead", e, msg)
 		}
 	}
 }
@@ -0,0 +1,320 @@
+package budgetchat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How many messages /history shows when not told otherwise
+const DEFAULT_HISTORY_REPLY = 10
+
+// A CommandFunc implements a slash command. It receives everything that
+// followed the command name, with surrounding whitespace removed. A returned
+// error is reported back to the user who issued the command.
+//
+// Commands run on the server's event loop, so they see a consistent view of
+// the chat but must not block.
+type CommandFunc func(s *Session, args string) error
+
+type Command struct {
+	// Shown by /help, e.g. "/msg <user> <text>"
+	Usage string
+	Help  string
+	Run   CommandFunc
+	// Only admins can see and run the command
+	AdminOnly bool
+}
+
+// Session gives commands access to the user that issued them.
+type Session struct {
+	c *chatServer
+	u *user
+}
+
+// The name of the user that issued the command
+func (s *Session) Name() string {
+	return s.u.name
+}
+
+// The room the user is currently in
+func (s *Session) Room() string {
+	return s.u.room
+}
+
+func (s *Session) IsAdmin() bool {
+	return s.u.admin
+}
+
+// Send a server message to the user that issued the command
+func (s *Session) Reply(format string, args ...any) {
+	s.u.out.pushLine("* " + fmt.Sprintf(format, args...))
+}
+
+// Say something to everyone else in the user's room, as if the user had sent
+// the text, including those on linked servers. Banned words are censored, and
+// muted users can't say anything.
+func (s *Session) Say(text string) {
+	if s.muted() {
+		return
+	}
+	s.c.post(s.u.room, s.u.name, s.c.moderation.censor(text))
+}
+
+// Send a server message about the user to everyone else in their room,
+// including those on linked servers, as in `* <text>`. Like what users say,
+// it's censored and kept in the room's history, and muted users can't send
+// any.
+func (s *Session) Announce(text string) {
+	if s.muted() {
+		return
+	}
+	s.c.announce(s.u.room, s.u.name, s.c.moderation.censor(text))
+}
+
+// Whether the user is muted, letting them know if they are
+func (s *Session) muted() bool {
+	if s.c.moderation.isMuted(s.u.name) {
+		s.Reply("You are muted")
+		return true
+	}
+	return false
+}
+
+// Disconnect the user once everything sent to them so far is delivered
+func (s *Session) Disconnect() {
+	s.u.disconnect()
+}
+
+var (
+	commands   = make(map[string]Command)
+	commandsMu sync.RWMutex
+)
+
+// RegisterCommand makes a command available as /name on every budgetchat
+// server, replacing any existing command with the same name.
+func RegisterCommand(name string, cmd Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[name] = cmd
+}
+
+func lookupCommand(name string) (Command, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	cmd, ok := commands[name]
+	return cmd, ok
+}
+
+func init() {
+	RegisterCommand("help", Command{
+		Usage: "/help",
+		Help:  "List the available commands",
+		Run:   helpCommand,
+	})
+	RegisterCommand("join", Command{
+		Usage: "/join <room>",
+		Help:  "Move to another room, creating it if needed",
+		Run:   joinCommand,
+	})
+	RegisterCommand("leave", Command{
+		Usage: "/leave",
+		Help:  "Go back to the " + DEFAULT_ROOM + " room",
+		Run:   leaveCommand,
+	})
+	RegisterCommand("rooms", Command{
+		Usage: "/rooms",
+		Help:  "List the rooms and how many users are in them",
+		Run:   roomsCommand,
+	})
+	RegisterCommand("who", Command{
+		Usage: "/who",
+		Help:  "List the users in the current room",
+		Run:   whoCommand,
+	})
+	RegisterCommand("say", Command{
+		Usage: "/say <text>",
+		Help:  "Say something, even if it starts with a slash",
+		Run:   sayCommand,
+	})
+	RegisterCommand("me", Command{
+		Usage: "/me <action>",
+		Help:  "Tell the room what you're doing",
+		Run:   meCommand,
+	})
+	RegisterCommand("msg", Command{
+		Usage: "/msg <user> <text>",
+		Help:  "Send a private message",
+		Run:   msgCommand,
+	})
+	RegisterCommand("nick", Command{
+		Usage: "/nick <name>",
+		Help:  "Change your name",
+		Run:   nickCommand,
+	})
+	RegisterCommand("history", Command{
+		Usage: "/history [n]",
+		Help:  fmt.Sprintf("Show the last n messages sent to the room (%d by default)", DEFAULT_HISTORY_REPLY),
+		Run:   historyCommand,
+	})
+	RegisterCommand("quit", Command{
+		Usage: "/quit",
+		Help:  "Leave the chat",
+		Run:   quitCommand,
+	})
+}
+
+// Commands are lines starting with a slash and the name of a command the user
+// can run. Anything else, like "/shrug" or "/o\", is a message as it always
+// was, so that clients that know nothing of commands keep working.
+func isCommand(msg string, admin bool) bool {
+	if len(msg) < 2 || msg[0] != '/' {
+		return false
+	}
+	name, _, _ := strings.Cut(msg[1:], " ")
+	cmd, ok := lookupCommand(name)
+	return ok && (!cmd.AdminOnly || admin)
+}
+
+func (c *chatServer) runCommand(u *user, msg string) {
+	name, args, _ := strings.Cut(msg[1:], " ")
+	s := &Session{c: c, u: u}
+
+	cmd, _ := lookupCommand(name)
+	if err := cmd.Run(s, strings.TrimSpace(args)); err != nil {
+		s.Reply("%s", err)
+	}
+}
+
+func usageError(usage string) error {
+	return fmt.Errorf("Usage: %s", usage)
+}
+
+func helpCommand(s *Session, args string) error {
+	commandsMu.RLock()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		if commands[name].AdminOnly && !s.u.admin {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s", commands[name].Usage, commands[name].Help))
+	}
+	commandsMu.RUnlock()
+
+	for _, line := range lines {
+		s.Reply("%s", line)
+	}
+	return nil
+}
+
+func joinCommand(s *Session, args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return usageError("/join <room>")
+	}
+	if !isValidRoomName(args) {
+		return fmt.Errorf("Illegal room name")
+	}
+	if args == s.u.room {
+		return fmt.Errorf("You are already in %s", args)
+	}
+	s.c.move(s.u, args)
+	return nil
+}
+
+func leaveCommand(s *Session, args string) error {
+	if s.u.room == DEFAULT_ROOM {
+		return fmt.Errorf("You are already in %s", DEFAULT_ROOM)
+	}
+	s.c.move(s.u, DEFAULT_ROOM)
+	return nil
+}
+
+func roomsCommand(s *Session, args string) error {
+	s.Reply("Rooms: %s", strings.Join(s.c.roomList(), ", "))
+	return nil
+}
+
+func whoCommand(s *Session, args string) error {
+	s.u.out.push(chatEvent{Type: eventMembers, Room: s.u.room, Members: s.c.rooms[s.u.room].listing()})
+	return nil
+}
+
+func sayCommand(s *Session, args string) error {
+	if args == "" {
+		return usageError("/say <text>")
+	}
+	s.Say(args)
+	return nil
+}
+
+func meCommand(s *Session, args string) error {
+	if args == "" {
+		return usageError("/me <action>")
+	}
+	if !s.muted() {
+		s.c.act(s.u.room, s.u.name, s.c.moderation.censor(args))
+	}
+	return nil
+}
+
+func msgCommand(s *Session, args string) error {
+	name, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if name == "" || text == "" {
+		return usageError("/msg <user> <text>")
+	}
+
+	if s.c.moderation.isMuted(s.u.name) {
+		return fmt.Errorf("You are muted")
+	}
+
+	text = s.c.moderation.censor(text)
+
+	if err := s.c.whisper(s.u.name, name, text); err != nil {
+		return err
+	}
+	if target, ok := s.c.lookup(name); ok && target.away != "" {
+		s.Reply("%s is away: %s", target.name, target.away)
+	}
+	return nil
+}
+
+func nickCommand(s *Session, args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return usageError("/nick <name>")
+	}
+	return s.c.rename(s.u, args)
+}
+
+func historyCommand(s *Session, args string) error {
+	n := DEFAULT_HISTORY_REPLY
+	if args != "" {
+		var err error
+		n, err = strconv.Atoi(args)
+		if err != nil || n <= 0 {
+			return usageError("/history [n]")
+		}
+	}
+
+	entries := s.c.rooms[s.u.room].history.last(n)
+	if len(entries) == 0 {
+		s.Reply("Nothing has been said here yet")
+	}
+	for _, entry := range entries {
+		s.u.out.pushLine(entry.String())
+	}
+	return nil
+}
+
+func quitCommand(s *Session, args string) error {
+	s.Disconnect()
+	return nil
+}
@@ -0,0 +1,351 @@
+package budgetchat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"protohackers/protos"
+	"strings"
+	"time"
+)
+
+// Servers can be linked together so that their users share the same rooms.
+// Linked servers exchange the events happening in their rooms as JSON
+// objects, one per line, starting with a hello carrying the name of the
+// server and the secret shared by every linked server. Once a server has
+// checked the other's hello, it sends a join for each of its users and then
+// events as they happen. Events carry what users said rather than the lines
+// shown for it, which each server puts together itself. They're never
+// relayed, so every server has to be linked to every other one.
+const (
+	PEER_HELLO   = "hello"
+	PEER_JOIN    = "join"
+	PEER_LEAVE   = "leave"
+	PEER_QUIT    = "quit"
+	PEER_MESSAGE = "message"
+	PEER_ACTION  = "action"
+	PEER_NOTICE  = "notice"
+	PEER_RENAME  = "rename"
+	PEER_PRIVATE = "private"
+)
+
+// How many events can be waiting to be sent to another server before the
+// link is considered broken
+const PEER_QUEUE_SIZE = 10000
+
+const PEER_RECONNECT_DELAY = time.Second
+
+// Messages can be as long as clients can send, and get longer once escaped
+const MAX_PEER_EVENT_SIZE = 1024 * 1024
+
+type peerEvent struct {
+	Type string `json:"type"`
+	// Hello
+	Server string `json:"server,omitempty"`
+	Secret string `json:"secret,omitempty"`
+
+	Room string `json:"room,omitempty"`
+	User string `json:"user,omitempty"`
+	// Recipient of a private message
+	To string `json:"to,omitempty"`
+	// What was said, done or announced, a private message, or a new name
+	Text string `json:"text,omitempty"`
+}
+
+// Whether an event can be shown to users without breaking up the lines
+// they're sent
+func (e peerEvent) valid() bool {
+	for _, s := range []string{e.Server, e.Room, e.User, e.To, e.Text} {
+		if strings.ContainsAny(s, "\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// A link to another server
+type peer struct {
+	// Known once we've got their hello
+	name string
+	out  *outbox
+}
+
+// A user connected to another server
+type remoteUser struct {
+	name   string
+	server string
+	room   string
+}
+
+func randomServerName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *chatServer) servePeers(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+	go protos.Serve(listener, c.handlePeer)
+	return listener, nil
+}
+
+// Keep a link to another server up for as long as this one is running
+func (c *chatServer) dialPeer(address string) {
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			fmt.Printf("Failed to connect to peer %s: %s\n", address, err)
+		} else {
+			c.handlePeer(conn)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(PEER_RECONNECT_DELAY):
+		}
+	}
+}
+
+func (c *chatServer) handlePeer(conn net.Conn) {
+	defer conn.Close()
+
+	p := &peer{out: newOutbox(PEER_QUEUE_SIZE, DisconnectSlowClient, "", func() { conn.Close() })}
+	p.out.pushLine(encodePeerEvent(peerEvent{Type: PEER_HELLO, Server: c.name, Secret: c.opts.PeerSecret}))
+	defer c.do(func() { c.unlink(p) })
+
+	go func() {
+		defer conn.Close()
+		for {
+			line, ok := p.out.next()
+			if !ok {
+				return
+			}
+			if err := writeLine(conn, "%s", line); err != nil {
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MAX_PEER_EVENT_SIZE)
+
+	for scanner.Scan() {
+		var e peerEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Printf("Invalid event from peer, dropping link: %s\n", err)
+			return
+		}
+		if !e.valid() {
+			fmt.Printf("Invalid %s event from peer, dropping link\n", e.Type)
+			return
+		}
+
+		linked := true
+		c.do(func() { linked = c.applyPeerEvent(p, e) })
+		if !linked {
+			return
+		}
+	}
+}
+
+// Apply an event received from another server. Returns false if the link
+// should be dropped.
+func (c *chatServer) applyPeerEvent(p *peer, e peerEvent) bool {
+	if p.name == "" {
+		if e.Type != PEER_HELLO {
+			fmt.Printf("Expected hello from peer, got %s\n", e.Type)
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(e.Secret), []byte(c.opts.PeerSecret)) != 1 {
+			fmt.Printf("Invalid secret from peer %s, dropping link\n", e.Server)
+			return false
+		}
+		if e.Server == "" || e.Server == c.name || c.peerNamed(e.Server) != nil {
+			fmt.Printf("Already linked to %s, dropping link\n", e.Server)
+			return false
+		}
+
+		// Sending everyone here and subscribing to further events in one go
+		// makes sure the other server doesn't miss anything in between
+		p.name = e.Server
+		for _, u := range c.users {
+			p.out.pushLine(encodePeerEvent(peerEvent{Type: PEER_JOIN, Room: u.room, User: u.name}))
+		}
+		for _, b := range c.bots {
+			p.out.pushLine(encodePeerEvent(peerEvent{Type: PEER_JOIN, Room: b.room, User: b.name}))
+		}
+		c.peers[p] = true
+		return true
+	}
+
+	switch e.Type {
+	case PEER_JOIN:
+		c.remoteJoin(p.name, e.User, e.Room)
+
+	case PEER_LEAVE:
+		if ru := c.remoteUser(p.name, e.User); ru != nil && ru.room == e.Room {
+			c.remoteLeave(ru)
+		}
+
+	case PEER_QUIT:
+		if ru := c.remoteUser(p.name, e.User); ru != nil {
+			c.remoteLeave(ru)
+			delete(c.remote, c.opts.NamePolicy.key(ru.name))
+		}
+
+	case PEER_MESSAGE:
+		if ru := c.remoteUser(p.name, e.User); ru != nil && ru.room == e.Room {
+			c.rooms[e.Room].post(chatEvent{Type: eventMessage, User: ru.name, Text: e.Text})
+		}
+
+	case PEER_ACTION:
+		if ru := c.remoteUser(p.name, e.User); ru != nil && ru.room == e.Room {
+			c.rooms[e.Room].post(chatEvent{Type: eventAction, User: ru.name, Text: e.Text})
+		}
+
+	case PEER_NOTICE:
+		if ru := c.remoteUser(p.name, e.User); ru != nil && ru.room == e.Room {
+			c.rooms[e.Room].post(chatEvent{Type: eventNotice, User: ru.name, Text: e.Text})
+		}
+
+	case PEER_RENAME:
+		ru := c.remoteUser(p.name, e.User)
+		if ru == nil {
+			break
+		}
+		// Treat a rename into a name that's taken here as a new arrival
+		if _, ok := c.lookup(e.Text); ok {
+			c.remoteLeave(ru)
+			delete(c.remote, c.opts.NamePolicy.key(ru.name))
+			c.remoteJoin(p.name, e.Text, ru.room)
+			break
+		}
+		delete(c.remote, c.opts.NamePolicy.key(ru.name))
+		old := ru.name
+		ru.name = e.Text
+		c.remote[c.opts.NamePolicy.key(ru.name)] = ru
+		if r, ok := c.rooms[ru.room]; ok {
+			r.remoteRename(old, ru.name)
+		}
+
+	case PEER_PRIVATE:
+		if ru := c.remoteUser(p.name, e.User); ru != nil {
+			c.deliver(ru.name, e.To, e.Text)
+		}
+	}
+
+	return true
+}
+
+// Find a user that's connected to the given server
+func (c *chatServer) remoteUser(server string, name string) *remoteUser {
+	ru, ok := c.remote[c.opts.NamePolicy.key(name)]
+	if !ok || ru.server != server {
+		return nil
+	}
+	return ru
+}
+
+func (c *chatServer) peerNamed(name string) *peer {
+	for p := range c.peers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Place a user from another server in a room. If several servers have a user
+// with the same name, which can happen if they register at the same time,
+// the one on the server with the lowest name keeps it and the others are
+// disconnected.
+func (c *chatServer) remoteJoin(server string, name string, room string) {
+	key := c.opts.NamePolicy.key(name)
+
+	if _, ok := c.bots[key]; ok {
+		// Bots can't be disconnected, so they always keep their name
+		return
+	}
+	if u, ok := c.users[key]; ok {
+		if server > c.name {
+			// Our user wins, and the other server will sort out theirs
+			return
+		}
+		u.out.pushLine("* Name already in use, disconnecting!")
+		u.disconnect()
+	}
+
+	ru, ok := c.remote[key]
+	if ok && ru.server != server {
+		if server > ru.server {
+			return
+		}
+		c.remoteLeave(ru)
+		ok = false
+	}
+	if !ok {
+		ru = &remoteUser{name: name, server: server}
+		c.remote[key] = ru
+	}
+
+	if ru.room == room {
+		return
+	}
+	c.remoteLeave(ru)
+	ru.room = room
+	ru.name = name
+
+	r, ok := c.rooms[room]
+	if !ok {
+		r = newChatRoom(room, c.opts)
+		c.rooms[room] = r
+	}
+	r.remoteJoin(name, server)
+}
+
+// Take a user from another server out of their current room
+func (c *chatServer) remoteLeave(ru *remoteUser) {
+	if ru.room == "" {
+		return
+	}
+
+	if r, ok := c.rooms[ru.room]; ok {
+		r.remoteLeave(ru.name)
+		c.removeIfEmpty(ru.room)
+	}
+	ru.room = ""
+}
+
+// Drop a link, along with everyone that was on the other end of it
+func (c *chatServer) unlink(p *peer) {
+	delete(c.peers, p)
+	p.out.close()
+
+	for key, ru := range c.remote {
+		if ru.server == p.name {
+			c.remoteLeave(ru)
+			delete(c.remote, key)
+		}
+	}
+}
+
+// Let every linked server know about something a local user did
+func (c *chatServer) federate(e peerEvent) {
+	line := encodePeerEvent(e)
+	for p := range c.peers {
+		p.out.pushLine(line)
+	}
+}
+
+func encodePeerEvent(e peerEvent) string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
@@ -0,0 +1,62 @@
+package budgetchat
+
+import (
+	"fmt"
+	"time"
+)
+
+const HISTORY_TIME_FORMAT = "15:04:05"
+
+type historyEntry struct {
+	time time.Time
+	msg  string
+}
+
+func (e historyEntry) String() string {
+	return fmt.Sprintf("* [%s] %s", e.time.UTC().Format(HISTORY_TIME_FORMAT), e.msg)
+}
+
+// A history is a ring buffer holding the most recent messages sent to a room
+type history struct {
+	entries []historyEntry
+	// Index of the oldest entry once the buffer is full
+	start int
+	size  int
+}
+
+func newHistory(size int) *history {
+	if size < 0 {
+		size = 0
+	}
+	return &history{size: size}
+}
+
+func (h *history) add(msg string) {
+	if h.size == 0 {
+		return
+	}
+
+	entry := historyEntry{time: time.Now(), msg: msg}
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.start] = entry
+	h.start = (h.start + 1) % h.size
+}
+
+// The last n entries, oldest first, or none if n isn't positive
+func (h *history) last(n int) []historyEntry {
+	if n < 0 {
+		n = 0
+	}
+	if n > len(h.entries) {
+		n = len(h.entries)
+	}
+
+	result := make([]historyEntry, 0, n)
+	for i := len(h.entries) - n; i < len(h.entries); i++ {
+		result = append(result, h.entries[(h.start+i)%len(h.entries)])
+	}
+	return result
+}
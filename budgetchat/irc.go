@@ -0,0 +1,377 @@
+package budgetchat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"protohackers/protos"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The name the server goes by when talking to IRC clients
+const IRC_SERVER_NAME = "budgetchat"
+
+// Start accepting IRC clients. Only the bare minimum to chat is supported:
+// NICK, USER, JOIN, PRIVMSG, PART, QUIT, PING/PONG and NAMES. Each room is a
+// channel with the same name prefixed with `#`, and users are always on
+// exactly one channel.
+func (c *chatServer) serveIRC(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+	go protos.Serve(listener, func(conn net.Conn) {
+		c.handleConnection(newIRCConn(conn))
+	})
+	return listener, nil
+}
+
+// ircConn translates between IRC and the chat's line protocol, so that IRC
+// clients can be handled exactly like TCP clients. Commands read from the
+// client become the lines a TCP client would send, and the events the chat
+// sends become the IRC messages describing them. The few lines the chat
+// writes directly, and events that are just a line, become notices.
+type ircConn struct {
+	net.Conn
+	scanner *bufio.Scanner
+
+	// What's left of the last translated command
+	pending []byte
+	// A line written in several parts
+	partial []byte
+
+	// Everything below is shared by the reading and the writing side
+	mu       sync.Mutex
+	password string
+	nick     string
+	user     bool
+	// Whether the welcome prompt has been skipped
+	prompted bool
+	// Whether the chat accepted the nick
+	registered bool
+	// The channel the client was last told it's on
+	channel string
+	// The room the client will be on once every join has gone through
+	room string
+}
+
+func newIRCConn(conn net.Conn) *ircConn {
+	// Commands are held to the same limit as the chat's lines
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MAX_LINE_SIZE)
+	return &ircConn{Conn: conn, scanner: scanner}
+}
+
+func (c *ircConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if !c.scanner.Scan() {
+			if err := c.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+
+		command, params := parseIRCMessage(trimMessage(c.scanner.Text()))
+		lines, err := c.translateCommand(command, params)
+		if err != nil {
+			return 0, err
+		}
+		for _, l := range lines {
+			c.pending = append(c.pending, l...)
+			c.pending = append(c.pending, '\n')
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Work out what a TCP client would have sent for a command, replying to the
+// client directly for the ones that don't involve the chat
+func (c *ircConn) translateCommand(command string, params []string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch command {
+	case "":
+		return nil, nil
+
+	case "PASS":
+		if len(params) < 1 {
+			return nil, c.numeric("461", "PASS :Not enough parameters")
+		}
+		c.password = params[0]
+		return nil, nil
+
+	case "NICK":
+		if len(params) < 1 {
+			return nil, c.numeric("431", ":No nickname given")
+		}
+		if c.registered {
+			return []string{"/nick " + params[0]}, nil
+		}
+		c.nick = params[0]
+		return c.login(), nil
+
+	case "USER":
+		if c.registered {
+			return nil, c.numeric("462", ":You may not reregister")
+		}
+		c.user = true
+		return c.login(), nil
+
+	case "PING":
+		token := IRC_SERVER_NAME
+		if len(params) > 0 {
+			token = params[0]
+		}
+		return nil, c.send(":%s PONG %s :%s", IRC_SERVER_NAME, IRC_SERVER_NAME, token)
+
+	case "PONG":
+		return nil, nil
+
+	case "QUIT":
+		return nil, io.EOF
+	}
+
+	if !c.registered {
+		return nil, c.numeric("451", ":You have not registered")
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) < 1 {
+			return nil, c.numeric("461", "JOIN :Not enough parameters")
+		}
+		// Only one channel at a time, so the last one wins
+		channels := strings.Split(params[0], ",")
+		channel := channels[len(channels)-1]
+		room := strings.TrimPrefix(channel, "#")
+		if !strings.HasPrefix(channel, "#") || !isValidRoomName(room) {
+			return nil, c.numeric("403", "%s :No such channel", channel)
+		}
+		if room == c.room {
+			return nil, nil
+		}
+		c.room = room
+		return []string{"/join " + room}, nil
+
+	case "PART":
+		if len(params) < 1 {
+			return nil, c.numeric("461", "PART :Not enough parameters")
+		}
+		if params[0] != "#"+c.room {
+			return nil, c.numeric("442", "%s :You're not on that channel", params[0])
+		}
+		if c.room == DEFAULT_ROOM {
+			// There's nowhere else to go
+			return nil, c.send(":%s NOTICE %s :You can't leave #%s", IRC_SERVER_NAME, c.nick, DEFAULT_ROOM)
+		}
+		c.room = DEFAULT_ROOM
+		return []string{"/leave"}, nil
+
+	case "NAMES":
+		if len(params) > 0 && params[0] != "#"+c.room {
+			return nil, c.numeric("366", "%s :End of /NAMES list", params[0])
+		}
+		return []string{"/who"}, nil
+
+	case "PRIVMSG":
+		if len(params) < 2 {
+			return nil, c.numeric("461", "PRIVMSG :Not enough parameters")
+		}
+		target, text := params[0], params[1]
+		action, isAction := ctcpAction(text)
+
+		if !strings.HasPrefix(target, "#") {
+			if isAction {
+				text = action
+			}
+			return []string{fmt.Sprintf("/msg %s %s", target, text)}, nil
+		}
+		if target != "#"+c.room {
+			return nil, c.numeric("442", "%s :You're not on that channel", target)
+		}
+		if isAction {
+			return []string{"/me " + action}, nil
+		}
+		// IRC clients have commands of their own, so a leading slash is
+		// just part of what they say
+		if strings.HasPrefix(text, "/") {
+			return []string{"/say " + text}, nil
+		}
+		return []string{text}, nil
+	}
+
+	return nil, c.numeric("421", "%s :Unknown command", command)
+}
+
+// The login line, once the client has sent both NICK and USER
+func (c *ircConn) login() []string {
+	if c.nick == "" || !c.user {
+		return nil
+	}
+	if c.password != "" {
+		return []string{c.nick + " " + c.password}
+	}
+	return []string{c.nick}
+}
+
+func (c *ircConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.partial = append(c.partial, p...)
+
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.translateLine(string(c.partial[:i])); err != nil {
+			return 0, err
+		}
+		c.partial = c.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Send a line written by the chat as a notice
+func (c *ircConn) translateLine(line string) error {
+	if !c.prompted {
+		// IRC clients don't need to be asked for their name
+		c.prompted = true
+		return nil
+	}
+
+	if !c.registered {
+		// Whatever went wrong, the chat is about to hang up
+		return c.send("ERROR :%s", strings.TrimPrefix(line, "* "))
+	}
+	return c.send(":%s NOTICE %s :%s", IRC_SERVER_NAME, c.nick, strings.TrimPrefix(line, "* "))
+}
+
+// Send the IRC messages describing an event
+func (c *ircConn) writeEvent(e chatEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch e.Type {
+	case eventJoined:
+		if !c.registered {
+			c.registered = true
+			c.room = e.Room
+			if err := c.numeric("001", ":Welcome to budgetchat, %s", c.nick); err != nil {
+				return err
+			}
+		}
+		return c.joined(e.Room, ircNames(e.Members))
+
+	case eventMembers:
+		return c.names(ircNames(e.Members))
+	}
+
+	if !c.registered {
+		return c.translateLine(e.String())
+	}
+
+	switch e.Type {
+	case eventJoin:
+		return c.send(":%s JOIN #%s", e.User, c.channel)
+	case eventLeave:
+		return c.send(":%s PART #%s", e.User, c.channel)
+	case eventRename:
+		if e.User == c.nick {
+			c.nick = e.Text
+		}
+		return c.send(":%s NICK %s", e.User, e.Text)
+	case eventMessage:
+		return c.send(":%s PRIVMSG #%s :%s", e.User, c.channel, e.Text)
+	case eventAction:
+		return c.send(":%s PRIVMSG #%s :\x01ACTION %s\x01", e.User, c.channel, e.Text)
+	case eventPrivate:
+		return c.send(":%s PRIVMSG %s :%s", e.User, e.To, e.Text)
+	}
+	return c.translateLine(e.String())
+}
+
+// The names in a room listing, without any status shown next to them
+func ircNames(members []string) string {
+	names := make([]string, 0, len(members))
+	for _, n := range members {
+		n, _, _ = strings.Cut(n, " ")
+		names = append(names, n)
+	}
+	return strings.Join(names, " ")
+}
+
+// Tell the client it moved to a channel, along with who's there. Unlike the
+// chat's listing, IRC's includes the client itself.
+func (c *ircConn) joined(room string, members string) error {
+	names := append(strings.Fields(members), c.nick)
+	sort.Strings(names)
+	members = strings.Join(names, " ")
+
+	if c.channel != "" {
+		if err := c.send(":%s PART #%s", c.nick, c.channel); err != nil {
+			return err
+		}
+	}
+	c.channel = room
+	if err := c.send(":%s JOIN #%s", c.nick, c.channel); err != nil {
+		return err
+	}
+	return c.names(members)
+}
+
+func (c *ircConn) names(members string) error {
+	if err := c.numeric("353", "= #%s :%s", c.channel, members); err != nil {
+		return err
+	}
+	return c.numeric("366", "#%s :End of /NAMES list", c.channel)
+}
+
+// Send a numeric reply, addressed to the client
+func (c *ircConn) numeric(code string, format string, args ...any) error {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	return c.send(":%s %s %s %s", IRC_SERVER_NAME, code, nick, fmt.Sprintf(format, args...))
+}
+
+func (c *ircConn) send(format string, args ...any) error {
+	_, err := io.WriteString(c.Conn, fmt.Sprintf(format, args...)+"\r\n")
+	return err
+}
+
+// Split an IRC message into its command and parameters, ignoring the prefix
+func parseIRCMessage(line string) (string, []string) {
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// Extract the action from a CTCP ACTION, which is how IRC clients send /me
+func ctcpAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01ACTION ") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01"), true
+}
@@ -0,0 +1,324 @@
+package budgetchat
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const DEFAULT_BAN_DURATION = time.Hour
+
+const DEFAULT_MUTE_DURATION = 10 * time.Minute
+
+const RATE_LIMIT_WARNING = "* You are sending messages too quickly, slow down!"
+
+const RATE_LIMIT_NOTICE = "* You were warned, disconnecting!"
+
+// Bans and mutes, only ever accessed from the server's event loop. Names are
+// compared by their name policy key, so a ban can't be dodged by changing
+// the case of one's name, for instance.
+type moderation struct {
+	bannedNames map[string]time.Time
+	bannedHosts map[string]time.Time
+	muted       map[string]time.Time
+	filter      *regexp.Regexp
+	names       NamePolicy
+}
+
+func newModeration(bannedWords []string, names NamePolicy) *moderation {
+	m := &moderation{
+		bannedNames: make(map[string]time.Time),
+		bannedHosts: make(map[string]time.Time),
+		muted:       make(map[string]time.Time),
+		names:       names,
+	}
+
+	if len(bannedWords) > 0 {
+		quoted := make([]string, 0, len(bannedWords))
+		for _, w := range bannedWords {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+		m.filter = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+
+	return m
+}
+
+// Replace every banned word in the text with asterisks
+func (m *moderation) censor(text string) string {
+	if m.filter == nil {
+		return text
+	}
+	return m.filter.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", len(word))
+	})
+}
+
+func (m *moderation) isBanned(name string, host string) bool {
+	return isActive(m.bannedNames, m.names.key(name)) || isActive(m.bannedHosts, host)
+}
+
+func (m *moderation) ban(name string, expiry time.Time) {
+	m.bannedNames[m.names.key(name)] = expiry
+}
+
+// Lift a ban on either a name or an address, returning whether there was one
+func (m *moderation) unban(target string) bool {
+	key := m.names.key(target)
+	_, byName := m.bannedNames[key]
+	_, byHost := m.bannedHosts[target]
+	delete(m.bannedNames, key)
+	delete(m.bannedHosts, target)
+	return byName || byHost
+}
+
+func (m *moderation) isMuted(name string) bool {
+	return isActive(m.muted, m.names.key(name))
+}
+
+func (m *moderation) mute(name string, expiry time.Time) {
+	m.muted[m.names.key(name)] = expiry
+}
+
+func (m *moderation) unmute(name string) {
+	delete(m.muted, m.names.key(name))
+}
+
+// Carry over any mute when a user changes names
+func (m *moderation) rename(old string, name string) {
+	if expiry, ok := m.muted[m.names.key(old)]; ok {
+		m.unmute(old)
+		m.muted[m.names.key(name)] = expiry
+	}
+}
+
+// Check whether an entry with an expiry is still in force, forgetting about
+// it if it isn't
+func isActive(entries map[string]time.Time, key string) bool {
+	expiry, ok := entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(entries, key)
+		return false
+	}
+	return true
+}
+
+// A token bucket limiting how often a user can send messages
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	warned bool
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (r *rateLimiter) allow() bool {
+	if r == nil {
+		return true
+	}
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Apply the rate limit to a user about to send a line. Users get a warning
+// the first time they go over it, and are disconnected the next.
+func (c *chatServer) checkRate(u *user) bool {
+	if u.limiter.allow() {
+		return true
+	}
+
+	if u.limiter.warned {
+		u.out.pushLine(RATE_LIMIT_NOTICE)
+		u.disconnect()
+	} else {
+		u.limiter.warned = true
+		u.out.pushLine(RATE_LIMIT_WARNING)
+	}
+	return false
+}
+
+func init() {
+	RegisterCommand("kick", Command{
+		Usage:     "/kick <user> [reason]",
+		Help:      "Disconnect a user",
+		Run:       kickCommand,
+		AdminOnly: true,
+	})
+	RegisterCommand("ban", Command{
+		Usage:     "/ban <user or IP> [duration]",
+		Help:      fmt.Sprintf("Keep a name or an address out (for %s by default)", DEFAULT_BAN_DURATION),
+		Run:       banCommand,
+		AdminOnly: true,
+	})
+	RegisterCommand("unban", Command{
+		Usage:     "/unban <name or IP>",
+		Help:      "Lift a ban",
+		Run:       unbanCommand,
+		AdminOnly: true,
+	})
+	RegisterCommand("mute", Command{
+		Usage:     "/mute <user> [duration]",
+		Help:      fmt.Sprintf("Stop a user from talking (for %s by default)", DEFAULT_MUTE_DURATION),
+		Run:       muteCommand,
+		AdminOnly: true,
+	})
+	RegisterCommand("unmute", Command{
+		Usage:     "/unmute <user>",
+		Help:      "Let a muted user talk again",
+		Run:       unmuteCommand,
+		AdminOnly: true,
+	})
+}
+
+// Parse arguments of the form "<target> [duration]"
+func targetAndDuration(args string, usage string, fallback time.Duration) (string, time.Duration, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", 0, usageError(usage)
+	}
+
+	d := fallback
+	if len(fields) == 2 {
+		var err error
+		d, err = time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("Invalid duration: %s", fields[1])
+		}
+	}
+	return fields[0], d, nil
+}
+
+func (s *Session) kick(target *user, notice string) {
+	target.out.pushLine(notice)
+	target.disconnect()
+	s.Reply("%s has been disconnected", target.name)
+}
+
+func kickCommand(s *Session, args string) error {
+	name, reason, _ := strings.Cut(args, " ")
+	if name == "" {
+		return usageError("/kick <user> [reason]")
+	}
+
+	target, ok := s.c.lookup(name)
+	if !ok {
+		if b, ok := s.c.lookupBot(name); ok {
+			s.c.removeBot(b)
+			s.Reply("%s has been removed", b.name)
+			return nil
+		}
+		return fmt.Errorf("No such user: %s", name)
+	}
+
+	notice := fmt.Sprintf("* You have been kicked by %s", s.u.name)
+	if reason = strings.TrimSpace(reason); reason != "" {
+		notice += ": " + reason
+	}
+	s.kick(target, notice)
+	return nil
+}
+
+func banCommand(s *Session, args string) error {
+	name, d, err := targetAndDuration(args, "/ban <user or IP> [duration]", DEFAULT_BAN_DURATION)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(d)
+
+	// Addresses are only banned when asked for, as many users can share one
+	// behind NAT or a proxy. Whoever issued the ban stays either way.
+	if ip := net.ParseIP(name); ip != nil {
+		s.c.moderation.bannedHosts[ip.String()] = expiry
+		for _, u := range s.c.users {
+			if u.host == ip.String() && u != s.u {
+				s.kick(u, "* You have been banned, disconnecting!")
+			}
+		}
+		s.Reply("%s is banned for %s", name, d)
+		return nil
+	}
+
+	// Users can be banned by name even if they aren't around
+	s.c.moderation.ban(name, expiry)
+	if target, ok := s.c.lookup(name); ok && target != s.u {
+		s.kick(target, "* You have been banned, disconnecting!")
+	}
+	if b, ok := s.c.lookupBot(name); ok {
+		s.c.removeBot(b)
+	}
+	s.Reply("%s is banned for %s", name, d)
+	return nil
+}
+
+func unbanCommand(s *Session, args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return usageError("/unban <name or IP>")
+	}
+
+	if !s.c.moderation.unban(args) {
+		return fmt.Errorf("%s is not banned", args)
+	}
+	s.Reply("%s is no longer banned", args)
+	return nil
+}
+
+func muteCommand(s *Session, args string) error {
+	name, d, err := targetAndDuration(args, "/mute <user> [duration]", DEFAULT_MUTE_DURATION)
+	if err != nil {
+		return err
+	}
+
+	target, ok := s.c.lookup(name)
+	if _, isBot := s.c.lookupBot(name); !ok && !isBot {
+		return fmt.Errorf("No such user: %s", name)
+	}
+
+	s.c.moderation.mute(name, time.Now().Add(d))
+	if ok {
+		target.out.pushLine(fmt.Sprintf("* You have been muted for %s", d))
+	}
+	s.Reply("%s is muted for %s", name, d)
+	return nil
+}
+
+func unmuteCommand(s *Session, args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return usageError("/unmute <user>")
+	}
+	if !s.c.moderation.isMuted(args) {
+		return fmt.Errorf("%s is not muted", args)
+	}
+
+	s.c.moderation.unmute(args)
+	if target, ok := s.c.lookup(args); ok {
+		target.out.pushLine("* You are no longer muted")
+	}
+	s.Reply("%s is no longer muted", args)
+	return nil
+}
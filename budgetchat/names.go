@@ -0,0 +1,122 @@
+package budgetchat
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const DEFAULT_MAX_NAME_LENGTH = 32
+
+// A NamePolicy decides which user names are acceptable and when two names
+// are too similar to be told apart.
+type NamePolicy struct {
+	// Maximum length in characters. Defaults to DEFAULT_MAX_NAME_LENGTH.
+	MaxLength int
+	// Allow letters and digits from any script rather than just ASCII ones.
+	// Names are normalized to NFC, and names that only differ by accents or
+	// by look-alike characters from other scripts are considered the same.
+	AllowUnicode bool
+	// Characters allowed in addition to letters and digits, e.g. "_-"
+	ExtraCharacters string
+	// Names nobody can take
+	Reserved []string
+	// Treat names that only differ in case as different ones
+	CaseSensitive bool
+}
+
+func (p NamePolicy) maxLength() int {
+	if p.MaxLength <= 0 {
+		return DEFAULT_MAX_NAME_LENGTH
+	}
+	return p.MaxLength
+}
+
+// Check a name against the policy, returning the form it should be shown as
+func (p NamePolicy) normalize(name string) (string, error) {
+	if p.AllowUnicode {
+		name = norm.NFC.String(name)
+	}
+
+	if name == "" || !utf8.ValidString(name) {
+		return "", fmt.Errorf("Illegal name")
+	}
+	if utf8.RuneCountInString(name) > p.maxLength() {
+		return "", fmt.Errorf("Name is too long")
+	}
+
+	for i, r := range name {
+		if !p.isAllowed(r, i == 0) {
+			return "", fmt.Errorf("Illegal name")
+		}
+	}
+
+	key := p.key(name)
+	for _, reserved := range p.Reserved {
+		if p.key(reserved) == key {
+			return "", fmt.Errorf("Name is reserved")
+		}
+	}
+
+	return name, nil
+}
+
+func (p NamePolicy) isAllowed(r rune, first bool) bool {
+	if strings.ContainsRune(p.ExtraCharacters, r) {
+		return true
+	}
+	if r < utf8.RuneSelf {
+		return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+	}
+	if !p.AllowUnicode {
+		return false
+	}
+	// Combining marks that don't compose under NFC are fine, as long as
+	// they have something to combine with
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || (!first && unicode.Is(unicode.Mn, r))
+}
+
+// The key names are compared by to decide whether they're taken
+func (p NamePolicy) key(name string) string {
+	if p.AllowUnicode {
+		name = skeleton(name)
+	}
+	if !p.CaseSensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// Common characters from other scripts that look like ASCII letters
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O',
+	'Р': 'P', 'С': 'C', 'Т': 'T', 'Х': 'X', 'І': 'I', 'Ј': 'J', 'Ѕ': 'S',
+	// Greek
+	'α': 'a', 'ο': 'o', 'ρ': 'p', 'ν': 'v', 'ι': 'i', 'κ': 'k', 'τ': 't',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K',
+	'Μ': 'M', 'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+}
+
+// Reduce a name to what it looks like: compatibility characters (such as
+// full-width letters) are replaced by their plain equivalents, accents are
+// dropped and look-alike letters from other scripts are mapped to ASCII.
+func skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
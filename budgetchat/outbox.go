@@ -0,0 +1,181 @@
+package budgetchat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// What to do with a message for a client whose outbound queue is full
+type SlowClientPolicy int
+
+const (
+	// Disconnect the client after letting them know why
+	DisconnectSlowClient SlowClientPolicy = iota
+	// Discard the oldest queued message to make room for the new one
+	DropOldestMessage
+	// Discard the new message
+	DropNewestMessage
+)
+
+const SLOW_CLIENT_NOTICE = "* You are not keeping up with the room, disconnecting!"
+
+// What a chat event is about. Events without a type are just a line to send.
+const (
+	// The user joined a room, which has the given members
+	eventJoined = "joined"
+	// Who's in the user's room, as asked
+	eventMembers = "members"
+	eventJoin    = "join"
+	eventLeave   = "leave"
+	// Someone changed their name to the text
+	eventRename  = "rename"
+	eventMessage = "message"
+	// Something someone did, as with /me
+	eventAction = "action"
+	// A server message a command sent on behalf of someone
+	eventNotice  = "notice"
+	eventPrivate = "private"
+)
+
+// Something a client is sent. Most clients are sent the line it's shown as,
+// but those that don't speak the chat's protocol need to know what it's
+// about rather than working it out from a line that users have a say in.
+type chatEvent struct {
+	Type string
+	User string
+	// The room joined or listed
+	Room    string
+	Members []string
+	// Recipient of a private message
+	To string
+	// What was said or done, the new name, or the line to send
+	Text string
+}
+
+// A line to send as is
+func lineEvent(line string) chatEvent {
+	return chatEvent{Text: line}
+}
+
+// The line the event is shown as
+func (e chatEvent) String() string {
+	switch e.Type {
+	case eventJoined, eventMembers:
+		return fmt.Sprintf("* The room contains: %s", strings.Join(e.Members, ", "))
+	case eventJoin:
+		return fmt.Sprintf("* %s has entered the room", e.User)
+	case eventLeave:
+		return fmt.Sprintf("* %s has left the room", e.User)
+	case eventRename:
+		return fmt.Sprintf("* %s is now known as %s", e.User, e.Text)
+	case eventMessage:
+		return fmt.Sprintf("[%s] %s", e.User, e.Text)
+	case eventAction:
+		return fmt.Sprintf("* %s %s", e.User, e.Text)
+	case eventNotice:
+		return fmt.Sprintf("* %s", e.Text)
+	case eventPrivate:
+		return fmt.Sprintf("[%s -> %s] %s", e.User, e.To, e.Text)
+	}
+	return e.Text
+}
+
+// An outbox is a bounded queue of messages waiting to be written to a client.
+// Pushing never blocks, so a client that stops reading can't hold up anyone
+// else; what happens once the queue is full is decided by the policy.
+type outbox struct {
+	queue  []chatEvent
+	limit  int
+	policy SlowClientPolicy
+	closed bool
+	// The last message queued when disconnecting a slow client, if any
+	notice string
+	// Called once when the client is disconnected for being too slow
+	onEvict func()
+
+	ready chan struct{}
+	mu    sync.Mutex
+}
+
+func newOutbox(limit int, policy SlowClientPolicy, notice string, onEvict func()) *outbox {
+	return &outbox{
+		limit:   limit,
+		policy:  policy,
+		notice:  notice,
+		onEvict: onEvict,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) pushLine(line string) {
+	o.push(lineEvent(line))
+}
+
+func (o *outbox) push(msg chatEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	if len(o.queue) >= o.limit {
+		switch o.policy {
+		case DropOldestMessage:
+			o.queue = o.queue[1:]
+		case DropNewestMessage:
+			return
+		case DisconnectSlowClient:
+			// The notice goes in past the limit, and nothing else after it
+			o.closed = true
+			if o.onEvict != nil {
+				go o.onEvict()
+			}
+			if o.notice != "" {
+				o.queue = append(o.queue, lineEvent(o.notice))
+			}
+			o.signal()
+			return
+		}
+	}
+
+	o.queue = append(o.queue, msg)
+	o.signal()
+}
+
+// Wait for the next message. Returns false once the outbox has been closed
+// and everything queued before that has been handed out.
+func (o *outbox) next() (chatEvent, bool) {
+	for {
+		o.mu.Lock()
+		if len(o.queue) > 0 {
+			msg := o.queue[0]
+			o.queue = o.queue[1:]
+			o.mu.Unlock()
+			return msg, true
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return chatEvent{}, false
+		}
+		o.mu.Unlock()
+
+		<-o.ready
+	}
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	o.signal()
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,128 @@
+package budgetchat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How often users are checked for idleness, relative to the idle timeout
+const IDLE_CHECKS_PER_TIMEOUT = 4
+
+func init() {
+	RegisterCommand("away", Command{
+		Usage: "/away [message]",
+		Help:  "Let others know you're away, or that you're back if no message is given",
+		Run:   awayCommand,
+	})
+	RegisterCommand("whois", Command{
+		Usage: "/whois <user>",
+		Help:  "Show how long a user has been around and whether they're away",
+		Run:   whoisCommand,
+	})
+}
+
+// Note that the user just sent something, letting the room know they're no
+// longer idle if it had been told otherwise
+func (c *chatServer) touch(u *user) {
+	u.lastActive = time.Now()
+	if u.idle {
+		u.idle = false
+		c.rooms[u.room].broadcast(lineEvent(fmt.Sprintf("* %s is no longer idle", u.name)), u.name)
+	}
+}
+
+// Announce the users that have gone quiet for longer than the idle timeout
+func (c *chatServer) checkIdle(now time.Time) {
+	for _, u := range c.users {
+		if u.idle || u.gone || u.room == "" || now.Sub(u.lastActive) < c.opts.IdleTimeout {
+			continue
+		}
+		u.idle = true
+		c.rooms[u.room].broadcast(lineEvent(fmt.Sprintf("* %s is idle", u.name)), u.name)
+	}
+}
+
+// The users in the room, along with whether they're away or idle if the room
+// is set to show it
+func (c *chatRoom) listing() []string {
+	names := c.members()
+	if !c.showStatus {
+		return names
+	}
+
+	for i, n := range names {
+		u, ok := c.users[n]
+		switch {
+		case c.bots[n] != nil:
+			names[i] = fmt.Sprintf("%s (bot)", n)
+		case !ok:
+			// Nothing is known about users on linked servers
+		case u.away != "":
+			// The message itself can be seen with /whois
+			names[i] = fmt.Sprintf("%s (away)", n)
+		case u.idle:
+			names[i] = fmt.Sprintf("%s (idle)", n)
+		}
+	}
+	return names
+}
+
+func awayCommand(s *Session, args string) error {
+	args = s.c.moderation.censor(strings.TrimSpace(args))
+	room := s.c.rooms[s.u.room]
+
+	if args == "" {
+		if s.u.away == "" {
+			return fmt.Errorf("You are not away")
+		}
+		s.u.away = ""
+		s.Reply("You are no longer marked as away")
+		room.broadcast(lineEvent(fmt.Sprintf("* %s is back", s.u.name)), s.u.name)
+		return nil
+	}
+
+	// The message goes to the whole room, which muted users can't talk to
+	if s.muted() {
+		return nil
+	}
+	s.u.away = args
+	s.Reply("You are marked as away")
+	room.broadcast(lineEvent(fmt.Sprintf("* %s is away: %s", s.u.name, args)), s.u.name)
+	return nil
+}
+
+func whoisCommand(s *Session, args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return usageError("/whois <user>")
+	}
+
+	target, ok := s.c.lookup(args)
+	if !ok {
+		if b, ok := s.c.bots[s.c.opts.NamePolicy.key(args)]; ok {
+			s.Reply("%s is a bot in %s", b.name, b.room)
+			return nil
+		}
+		if ru, ok := s.c.remote[s.c.opts.NamePolicy.key(args)]; ok {
+			s.Reply("%s is in %s, on server %s", ru.name, ru.room, ru.server)
+			return nil
+		}
+		return fmt.Errorf("No such user: %s", args)
+	}
+
+	now := time.Now()
+	info := []string{
+		fmt.Sprintf("%s is in %s", target.name, target.room),
+		fmt.Sprintf("connected for %s", now.Sub(target.joined).Truncate(time.Second)),
+		fmt.Sprintf("idle for %s", now.Sub(target.lastActive).Truncate(time.Second)),
+	}
+	// Only admins get to know where people connect from
+	if s.u.admin {
+		info = append(info, fmt.Sprintf("from %s", target.addr))
+	}
+	if target.away != "" {
+		info = append(info, fmt.Sprintf("away: %s", target.away))
+	}
+	s.Reply("%s", strings.Join(info, ", "))
+	return nil
+}
@@ -0,0 +1,277 @@
+package budgetchat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TRANSCRIPT_JOIN    = "join"
+	TRANSCRIPT_LEAVE   = "leave"
+	TRANSCRIPT_MESSAGE = "message"
+	TRANSCRIPT_RENAME  = "rename"
+)
+
+// A TranscriptEvent is something that happened in a room
+type TranscriptEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Room string    `json:"room"`
+	User string    `json:"user"`
+	// The line as the room saw it, for messages, or the new name, for renames
+	Text string `json:"text,omitempty"`
+}
+
+// A TranscriptSink receives every join, leave and message in every room.
+// Events are recorded from the server's event loop, so it must be quick, and
+// leave anything slow like writing to disk to another goroutine.
+type TranscriptSink interface {
+	Record(e TranscriptEvent) error
+}
+
+const DEFAULT_TRANSCRIPT_FILE_SIZE = 10 * 1024 * 1024
+
+// How many events can be waiting to be written before new ones are dropped
+const TRANSCRIPT_QUEUE_SIZE = 1000
+
+const transcriptFilePattern = "transcript-*.jsonl"
+
+// TranscriptLog is a TranscriptSink that appends events as JSON lines to
+// numbered files in a directory, starting a new file whenever the current one
+// exceeds a given size. Events are written in the background, so that the
+// event loop never waits on the disk.
+type TranscriptLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	// Guards closed, so that nothing is queued once the log is closed
+	mu     sync.Mutex
+	closed bool
+	lines  chan []byte
+	done   chan struct{}
+
+	// Only touched by the goroutine writing
+	f     *os.File
+	size  int64
+	index int
+}
+
+// Open a transcript log in the given directory, creating it if needed and
+// appending to the latest file if there's one already. Files are rotated
+// once they reach maxSize bytes (DEFAULT_TRANSCRIPT_FILE_SIZE if zero), and
+// only the latest maxFiles are kept (all of them if zero).
+func OpenTranscriptLog(dir string, maxSize int64, maxFiles int) (*TranscriptLog, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_TRANSCRIPT_FILE_SIZE
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create transcript directory: %s", err)
+	}
+
+	files, err := transcriptFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TranscriptLog{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		index:    1,
+		lines:    make(chan []byte, TRANSCRIPT_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	if len(files) > 0 {
+		fmt.Sscanf(filepath.Base(files[len(files)-1]), "transcript-%d.jsonl", &l.index)
+	}
+
+	l.f, l.size, err = l.open(l.index)
+	if err != nil {
+		return nil, err
+	}
+	go l.write()
+	return l, nil
+}
+
+// Queue an event to be written
+func (l *TranscriptLog) Record(e TranscriptEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return fmt.Errorf("Transcript log is closed")
+	}
+	select {
+	case l.lines <- line:
+		return nil
+	default:
+		return fmt.Errorf("Transcript log is falling behind, dropping event")
+	}
+}
+
+// Write what's been recorded so far and close the current file
+func (l *TranscriptLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.lines)
+	l.mu.Unlock()
+
+	<-l.done
+	return l.f.Close()
+}
+
+func (l *TranscriptLog) write() {
+	defer close(l.done)
+
+	for line := range l.lines {
+		// Should rotating fail, the current file is kept and rotating is
+		// tried again on the next event
+		if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+			if err := l.rotate(); err != nil {
+				fmt.Printf("Failed to rotate transcript: %s\n", err)
+			}
+		}
+
+		n, err := l.f.Write(line)
+		l.size += int64(n)
+		if err != nil {
+			fmt.Printf("Failed to record transcript: %s\n", err)
+		}
+	}
+}
+
+func (l *TranscriptLog) open(index int) (*os.File, int64, error) {
+	name := filepath.Join(l.dir, fmt.Sprintf("transcript-%06d.jsonl", index))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to open transcript: %s", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("Failed to open transcript: %s", err)
+	}
+	return f, info.Size(), nil
+}
+
+// Move on to the next file, only letting go of the current one once the next
+// one is open
+func (l *TranscriptLog) rotate() error {
+	f, size, err := l.open(l.index + 1)
+	if err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		fmt.Printf("Failed to close transcript: %s\n", err)
+	}
+	l.f, l.size = f, size
+	l.index++
+
+	if l.maxFiles <= 0 {
+		return nil
+	}
+
+	files, err := transcriptFiles(l.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > l.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// The transcript files in a directory, oldest first
+func transcriptFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, transcriptFilePattern))
+	if err != nil {
+		return nil, err
+	}
+	// File names are zero-padded, so they sort in the order they were written
+	sort.Strings(files)
+	return files, nil
+}
+
+// Criteria for searching transcripts. Zero values match everything.
+type TranscriptFilter struct {
+	User  string
+	Since time.Time
+	Until time.Time
+	// Case-insensitive substring of the event text
+	Text string
+}
+
+func (f TranscriptFilter) Match(e TranscriptEvent) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Text != "" && !strings.Contains(strings.ToLower(e.Text), strings.ToLower(f.Text)) {
+		return false
+	}
+	return true
+}
+
+// Read every event in the transcripts written to dir matching the filter, in
+// the order they were recorded.
+func SearchTranscripts(dir string, filter TranscriptFilter) ([]TranscriptEvent, error) {
+	files, err := transcriptFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []TranscriptEvent{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var e TranscriptEvent
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				// Most likely a partial line from a crash, skip it
+				continue
+			}
+			if filter.Match(e) {
+				events = append(events, e)
+			}
+		}
+		err = s.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
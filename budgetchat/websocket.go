@@ -0,0 +1,143 @@
+package budgetchat
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The path WebSocket clients connect to
+const WEBSOCKET_PATH = "/chat"
+
+// Start an HTTP server accepting WebSocket connections to the chat
+func (c *chatServer) serveWebSocket(address string) (*http.Server, net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: c.checkOrigin}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(WEBSOCKET_PATH, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already responded with an error
+			return
+		}
+		// Lines are limited the same as for TCP clients, so that a single
+		// message can't take up any amount of memory
+		ws.SetReadLimit(MAX_LINE_SIZE)
+		c.handleConnection(&wsConn{Conn: ws})
+	})
+
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(listener)
+
+	return httpServer, listener, nil
+}
+
+// Whether a page from the request's origin can connect
+func (c *chatServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.opts.WebSocketOrigins) == 0 {
+		return true
+	}
+	for _, o := range c.opts.WebSocketOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn presents a WebSocket connection as a stream of lines, so that it can
+// be handled exactly like a TCP client. Each text message received is one
+// line, and each line written is sent as a text message.
+type wsConn struct {
+	*websocket.Conn
+
+	// What's left of the last message received
+	pending []byte
+	// A line written in several parts
+	partial []byte
+
+	// Guards writeDeadline, which is set from other goroutines than the one
+	// writing
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		c.pending = append(data, '\n')
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		// The WebSocket connection's own deadline is only ever touched here,
+		// by the goroutine writing
+		c.Conn.SetWriteDeadline(c.deadline())
+		if err := c.WriteMessage(websocket.TextMessage, c.partial[:i]); err != nil {
+			return 0, err
+		}
+		c.partial = c.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// The WebSocket connection only applies its write deadline as each write
+// starts, so a write already waiting on a client that isn't reading is
+// cut short once the deadline passes instead.
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			if c.deadline().Equal(t) {
+				c.UnderlyingConn().SetWriteDeadline(t)
+			}
+		})
+	}
+	return nil
+}
+
+func (c *wsConn) deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeDeadline
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
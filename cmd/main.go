@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"protohackers/budgetchat"
 	"protohackers/meanstoanend"
@@ -20,10 +21,81 @@ var servers = map[int]func(string) (protos.Server, error){
 	0: smoketest.Serve,
 	1: primetime.Serve,
 	2: meanstoanend.Serve,
-	3: budgetchat.Serve,
-	4: unusualdatabase.Serve,
+	3: func(addr string) (protos.Server, error) {
+		opts := budgetchat.Options{
+			WebSocketAddress: os.Getenv("BUDGETCHAT_WEBSOCKET_ADDRESS"),
+			IRCAddress:       os.Getenv("BUDGETCHAT_IRC_ADDRESS"),
+			ServerName:       os.Getenv("BUDGETCHAT_SERVER_NAME"),
+			PeerSecret:       os.Getenv("BUDGETCHAT_PEER_SECRET"),
+			PeerAddress:      os.Getenv("BUDGETCHAT_PEER_ADDRESS"),
+		}
+		// Comma separated addresses of other servers to link to
+		if peers := os.Getenv("BUDGETCHAT_PEERS"); peers != "" {
+			opts.Peers = strings.Split(peers, ",")
+		}
+		// Comma separated origins of the pages allowed to connect
+		if origins := os.Getenv("BUDGETCHAT_WEBSOCKET_ORIGINS"); origins != "" {
+			opts.WebSocketOrigins = strings.Split(origins, ",")
+		}
+
+		if dir := os.Getenv("BUDGETCHAT_TRANSCRIPT_DIR"); dir != "" {
+			transcript, err := budgetchat.OpenTranscriptLog(dir, 0, 0)
+			if err != nil {
+				return nil, err
+			}
+			opts.Transcript = transcript
+		}
+
+		server, err := budgetchat.ServeWithOptions(addr, opts)
+		if err != nil || os.Getenv("BUDGETCHAT_BOTS") == "" {
+			return server, err
+		}
+
+		// Put the example bots in the default room
+		bots := server.(interface {
+			AddBot(name string, room string, bot budgetchat.Bot) error
+		})
+		for name, bot := range map[string]budgetchat.Bot{
+			"greeter":  budgetchat.NewWelcomeBot("Welcome! Say !roll to roll a die, or /help for commands"),
+			"dice":     budgetchat.NewDiceBot(),
+			"reminder": budgetchat.NewReminderBot(),
+		} {
+			if err := bots.AddBot(name, budgetchat.DEFAULT_ROOM, bot); err != nil {
+				server.Close()
+				return nil, err
+			}
+		}
+		return server, nil
+	},
+	4: func(addr string) (protos.Server, error) {
+		opts := unusualdatabase.Options{
+			NodeName:    os.Getenv("UNUSUALDATABASE_NODE_NAME"),
+			PeerSecret:  os.Getenv("UNUSUALDATABASE_PEER_SECRET"),
+			PeerAddress: os.Getenv("UNUSUALDATABASE_PEER_ADDRESS"),
+			TCPAddress:  os.Getenv("UNUSUALDATABASE_TCP_ADDRESS"),
+			HTTPAddress: os.Getenv("UNUSUALDATABASE_HTTP_ADDRESS"),
+		}
+		// Comma separated peer addresses of other nodes to link to
+		if peers := os.Getenv("UNUSUALDATABASE_PEERS"); peers != "" {
+			opts.Peers = strings.Split(peers, ",")
+		}
+		return unusualdatabase.ServeWithOptions(addr, opts)
+	},
 	5: func(addr string) (protos.Server, error) {
-		return mobinthemiddle.Serve(addr, UPSTREAM_BUDGETCHAT_ADDRESS)
+		opts := mobinthemiddle.Options{RulesFile: os.Getenv("MOBINTHEMIDDLE_RULES_FILE")}
+		var stages []protos.Stage
+		if os.Getenv("MOBINTHEMIDDLE_LOG") != "" {
+			stages = append(stages, protos.LogLines(os.Stdout))
+		}
+		if path := os.Getenv("MOBINTHEMIDDLE_RECORD_FILE"); path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to open recording: %s", err)
+			}
+			stages = append(stages, protos.RecordLines(f))
+		}
+		opts.Upstream, opts.Downstream = stages, stages
+		return mobinthemiddle.ServeWithOptions(addr, UPSTREAM_BUDGETCHAT_ADDRESS, opts)
 	},
 }
 
@@ -0,0 +1,76 @@
+// Search the transcripts written by a budgetchat server.
+//
+// Usage:
+//
+//	transcripts -dir <directory> [-user <name>] [-since <time>] [-until <time>] [-text <text>]
+//
+// Times are given in RFC 3339 format, e.g. 2023-02-04T07:17:49Z.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"protohackers/budgetchat"
+)
+
+func main() {
+	dir := flag.String("dir", "", "directory the transcripts were written to")
+	user := flag.String("user", "", "only show events for this user")
+	since := flag.String("since", "", "only show events at or after this time")
+	until := flag.String("until", "", "only show events at or before this time")
+	text := flag.String("text", "", "only show events containing this text")
+	flag.Parse()
+
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "A transcript directory must be given with -dir")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter := budgetchat.TranscriptFilter{User: *user, Text: *text}
+
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -since: %s\n", err)
+		os.Exit(2)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -until: %s\n", err)
+		os.Exit(2)
+	}
+
+	events, err := budgetchat.SearchTranscripts(*dir, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read transcripts: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, e := range events {
+		fmt.Println(formatEvent(e))
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func formatEvent(e budgetchat.TranscriptEvent) string {
+	prefix := fmt.Sprintf("%s #%s", e.Time.UTC().Format(time.RFC3339), e.Room)
+
+	switch e.Type {
+	case budgetchat.TRANSCRIPT_JOIN:
+		return fmt.Sprintf("%s * %s has entered the room", prefix, e.User)
+	case budgetchat.TRANSCRIPT_LEAVE:
+		return fmt.Sprintf("%s * %s has left the room", prefix, e.User)
+	case budgetchat.TRANSCRIPT_RENAME:
+		return fmt.Sprintf("%s * %s is now known as %s", prefix, e.User, e.Text)
+	default:
+		return fmt.Sprintf("%s %s", prefix, e.Text)
+	}
+}
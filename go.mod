@@ -1,3 +1,8 @@
 module protohackers
 
 go 1.18
+
+require (
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/text v0.14.0
+)
@@ -1,16 +1,27 @@
 package meanstoanend
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bufio"
 	"fmt"
 	"io"
 	"net"
 	"protohackers/protos"
+	"protohackers/protos/codec"
 )
 
+// Every request takes this many bytes: its kind and two int32s
 const MESSAGE_SIZE = 9
 
+type request struct {
+	Kind   uint8
+	First  int32
+	Second int32
+}
+
+type response struct {
+	Mean int32
+}
+
 func Serve(address string) (protos.Server, error) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
@@ -30,57 +41,54 @@ func handler(conn net.Conn) {
 
 	data := map[int32]int32{}
 
-	for {
-		buf := make([]byte, MESSAGE_SIZE)
-		n, err := io.ReadFull(conn, buf)
-		if err != nil {
-			fmt.Printf("Unable to get the full response: %s", err)
-			break
-		}
-		if n != MESSAGE_SIZE {
-			fmt.Printf("Expected to get %d bytes in response, got %d", MESSAGE_SIZE, n)
-			break
-		}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	dec := codec.NewDecoder(r)
+	enc := codec.NewEncoder(w)
 
-		first, second, err := decodeRequestNumbers(buf)
+	// Both messages are reused for every request so that the steady state of
+	// the loop doesn't allocate.
+	req := &request{}
+	resp := &response{}
+
+	for {
+		err := dec.Decode(req)
 		if err != nil {
-			fmt.Printf("%s", err)
+			if err != io.EOF {
+				fmt.Printf("Unable to get the full message: %s\n", err)
+			}
 			break
 		}
 
-		switch buf[0] {
+		switch req.Kind {
 		case 'I':
-			timestamp, price := first, second
+			timestamp, price := req.First, req.Second
 			data[timestamp] = price
 
 		case 'Q':
-			minTime, maxTime := first, second
+			minTime, maxTime := req.First, req.Second
 
-			result := averageData(data, minTime, maxTime)
-			response := &bytes.Buffer{}
-			binary.Write(response, binary.BigEndian, result)
+			resp.Mean = averageData(data, minTime, maxTime)
 
-			io.Copy(conn, response)
+			if err := enc.Encode(resp); err != nil {
+				fmt.Printf("Failed to write response: %s\n", err)
+				return
+			}
 		}
-	}
-}
 
-func decodeRequestNumbers(request []byte) (int32, int32, error) {
-	a, err := decodeInt32(request[1:5])
-	if err != nil {
-		return 0, 0, fmt.Errorf("Failed to decode int32 value: %s", err)
-	}
-	b, err := decodeInt32(request[5:9])
-	if err != nil {
-		return 0, 0, fmt.Errorf("Failed to decode int32 value: %s", err)
+		// Only flush once no complete request is left in what the client has
+		// sent so far, so that pipelined queries are answered in a single
+		// write. Part of the next request may already be there, but waiting
+		// for the rest without flushing could leave the client waiting on us.
+		if r.Buffered() < MESSAGE_SIZE {
+			if err := w.Flush(); err != nil {
+				fmt.Printf("Failed to write response: %s\n", err)
+				return
+			}
+		}
 	}
-	return a, b, nil
-}
 
-func decodeInt32(b []byte) (int32, error) {
-	var result int32
-	err := binary.Read(bytes.NewBuffer(b), binary.BigEndian, &result)
-	return result, err
+	w.Flush()
 }
 
 func averageData(data map[int32]int32, minTime int32, maxTime int32) int32 {
@@ -1,7 +1,9 @@
 package meanstoanend_test
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"io"
 	"net"
 	"protohackers/meanstoanend"
@@ -108,6 +110,186 @@ func TestHandlesExampleSessionCorrectly(t *testing.T) {
 	assertResponse(t, buf, []byte{0x00, 0x00, 0x00, 0x65})
 }
 
+func TestAnswersPipelinedQueriesInOrder(t *testing.T) {
+	server, err := meanstoanend.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error establishing a connection: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		t.Fatalf("Failed to set deadline: %s\n", err)
+	}
+
+	// Send everything in a single write
+	request := bytes.Join([][]byte{
+		encodeMessage('I', 10, 100),
+		encodeMessage('I', 20, 200),
+		encodeMessage('Q', 0, 10),
+		encodeMessage('Q', 0, 20),
+		encodeMessage('Q', 30, 40),
+		encodeMessage('I', 30, -300),
+		encodeMessage('Q', 30, 40),
+	}, nil)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		t.Fatalf("Error sending data: %s\n", err)
+	}
+
+	for _, expected := range []int32{100, 150, 0, -300} {
+		buf := getResponse(t, conn)
+		assertResponse(t, buf, encodeInt32(expected))
+	}
+}
+
+func TestAnswersBeforeTheNextQueryIsComplete(t *testing.T) {
+	server, err := meanstoanend.Serve("localhost:")
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error establishing a connection: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		t.Fatalf("Failed to set deadline: %s\n", err)
+	}
+
+	// The query arrives along with the start of the next one, which only
+	// gets sent once the answer is in
+	next := encodeMessage('Q', 0, 10)
+	request := bytes.Join([][]byte{
+		encodeMessage('I', 10, 100),
+		encodeMessage('Q', 0, 10),
+		next[:4],
+	}, nil)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		t.Fatalf("Error sending data: %s\n", err)
+	}
+	assertResponse(t, getResponse(t, conn), encodeInt32(100))
+
+	_, err = conn.Write(next[4:])
+	if err != nil {
+		t.Fatalf("Error sending data: %s\n", err)
+	}
+	assertResponse(t, getResponse(t, conn), encodeInt32(100))
+}
+
+func BenchmarkInsert(b *testing.B) {
+	server, err := meanstoanend.Serve("localhost:")
+	if err != nil {
+		b.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		b.Fatalf("Error establishing a connection: %s", err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, 64*1024)
+	msg := make([]byte, 9)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// Keep the number of distinct timestamps bounded so that we measure
+		// the codec rather than the growth of the map.
+		putMessage(msg, 'I', int32(i%1024), int32(i))
+		w.Write(msg)
+	}
+
+	// A final query makes sure the server has processed every insert
+	putMessage(msg, 'Q', 0, 0)
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		b.Fatalf("Error sending data: %s\n", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		b.Fatalf("Unable to get the full response: %s", err)
+	}
+}
+
+func BenchmarkPipelinedQueries(b *testing.B) {
+	server, err := meanstoanend.Serve("localhost:")
+	if err != nil {
+		b.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		b.Fatalf("Error establishing a connection: %s", err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, 64*1024)
+	for i := 0; i < 16; i++ {
+		w.Write(encodeMessage('I', int32(i), int32(i*100)))
+	}
+	w.Flush()
+
+	// Drain the responses concurrently so that neither side blocks on a full
+	// socket buffer.
+	done := make(chan error)
+	go func(n int) {
+		_, err := io.CopyN(io.Discard, conn, int64(4*n))
+		done <- err
+	}(b.N)
+
+	query := encodeMessage('Q', 0, 15)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(query)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w.Write(query)
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatalf("Error sending data: %s\n", err)
+	}
+	if err := <-done; err != nil {
+		b.Fatalf("Unable to get the full response: %s", err)
+	}
+}
+
+func encodeMessage(kind byte, first int32, second int32) []byte {
+	msg := make([]byte, 9)
+	putMessage(msg, kind, first, second)
+	return msg
+}
+
+func putMessage(msg []byte, kind byte, first int32, second int32) {
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:5], uint32(first))
+	binary.BigEndian.PutUint32(msg[5:9], uint32(second))
+}
+
+func encodeInt32(n int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
 func getResponse(t *testing.T, conn io.Reader) []byte {
 	buf := make([]byte, 4)
 	n, err := io.ReadFull(conn, buf)
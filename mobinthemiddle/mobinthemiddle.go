@@ -1,86 +1,84 @@
 package mobinthemiddle
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"net"
 	"protohackers/protos"
-	"regexp"
-	"strings"
+	"time"
 )
 
-const TONY_ADDRESS = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
-
-var boguscoinRegexp = regexp.MustCompile(`^7[a-zA-Z0-9]{25,34}$`)
+type Options struct {
+	// A JSON file with the rules to apply, reloaded whenever it changes.
+	// Defaults to DefaultRules.
+	RulesFile string
+	// How often the rules file is checked for changes. Defaults to
+	// DEFAULT_RULES_RELOAD_INTERVAL.
+	ReloadInterval time.Duration
+
+	// More stages for lines to go through once rewritten, from the client to
+	// the server and back
+	Upstream   []protos.Stage
+	Downstream []protos.Stage
+}
 
 func Serve(address string, upstreamAddress string) (protos.Server, error) {
-	listener, err := net.Listen("tcp", address)
+	return ServeWithOptions(address, upstreamAddress, Options{})
+}
+
+func ServeWithOptions(address string, upstreamAddress string, opts Options) (protos.Server, error) {
+	var rules *Rules
+	var err error
+	if opts.RulesFile != "" {
+		rules, err = LoadRules(opts.RulesFile)
+	} else {
+		rules, err = NewRules(DefaultRules)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Failed to listen: %s\n", err)
+		return nil, err
 	}
 
-	handler := func(conn net.Conn) {
-		handler(conn, upstreamAddress)
+	rewrite := protos.RewriteLines(rules.Rewrite)
+	proxy, err := protos.ServeProxy(address, upstreamAddress, protos.ProxyOptions{
+		Upstream:   append([]protos.Stage{rewrite}, opts.Upstream...),
+		Downstream: append([]protos.Stage{rewrite}, opts.Downstream...),
+	})
+	if err != nil {
+		return nil, err
 	}
+	rules.Watch(opts.ReloadInterval)
 
-	go protos.Serve(listener, handler)
-
-	return &server{Listener: listener}, nil
+	return &server{ProxyServer: proxy, rules: rules}, nil
 }
 
 type server struct {
-	net.Listener
+	*protos.ProxyServer
+	rules *Rules
 }
 
-func handler(conn net.Conn, addr string) {
-	upstream, err := net.Dial("tcp", addr)
-	if err != nil {
-		fmt.Printf("Error establishing a connection to upstream server: %s", err)
-		return
-	}
-
-	go Tamper(conn, upstream)
-	go Tamper(upstream, conn)
+// How many replacements each rule made so far, by name
+func (s *server) RuleHits() map[string]uint64 {
+	return s.rules.Hits()
 }
 
-func Tamper(src io.ReadCloser, dst io.WriteCloser) {
-	s := bufio.NewScanner(src)
-	s.Split(scanCompleteLines)
-
-	for s.Scan() {
-		err := writeLine(dst, rewriteBogus(s.Text()))
-		if err != nil {
-			src.Close()
-			return
-		}
+// Load the rules file again, without waiting for it to be noticed
+func (s *server) ReloadRules() error {
+	if s.rules.path == "" {
+		return fmt.Errorf("No rules file")
 	}
-
-	dst.Close()
+	return s.rules.Reload()
 }
 
-func writeLine(w io.Writer, s string) error {
-	_, err := io.WriteString(w, s+"\n")
+func (s *server) Close() error {
+	err := s.ProxyServer.Close()
+	s.rules.Close()
 	return err
 }
 
-func rewriteBogus(in string) string {
-	words := strings.Split(in, " ")
-	for i, word := range words {
-		if boguscoinRegexp.MatchString(word) {
-			words[i] = TONY_ADDRESS
-		}
-	}
-	return strings.Join(words, " ")
-}
-
-// A modification over the standard `ScanLines` that won't yield incomplete lines
-func scanCompleteLines(data []byte, atEOF bool) (int, []byte, error) {
-	// Stop and don't return anything if we hit EOF
-	if atEOF {
-		return 0, nil, nil
-	}
-
-	// For everything else, delegate to `bufio.ScanLines`
-	return bufio.ScanLines(data, atEOF)
+// Relay complete lines from one side to the other, rewriting them with the
+// default rules
+func Tamper(src io.ReadCloser, dst io.WriteCloser) {
+	rules, _ := NewRules(DefaultRules)
+	protos.Pipe(src, dst, []protos.Transformer{
+		protos.RewriteLines(rules.Rewrite)(protos.ProxyStream{Direction: DIRECTION_BOTH}),
+	})
 }
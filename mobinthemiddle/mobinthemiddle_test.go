@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"protohackers/budgetchat"
 	"protohackers/mobinthemiddle"
 	"strings"
@@ -139,6 +141,141 @@ func TestExampleSession(t *testing.T) {
 	}
 }
 
+func TestRuleKinds(t *testing.T) {
+	rules, err := mobinthemiddle.NewRules([]mobinthemiddle.Rule{
+		{Name: "literal", Match: mobinthemiddle.MATCH_LITERAL, Pattern: "cat", Replace: "dog"},
+		{Name: "regex", Match: mobinthemiddle.MATCH_REGEX, Pattern: `(\d+) coins`, Replace: "${1}0 coins"},
+		{Name: "word", Match: mobinthemiddle.MATCH_WORD, Pattern: "hi|hello", Replace: "greetings"},
+		{Name: "up", Match: mobinthemiddle.MATCH_LITERAL, Pattern: "!", Replace: ".", Direction: mobinthemiddle.DIRECTION_UPSTREAM},
+		{Name: "price", Match: mobinthemiddle.MATCH_WORD, Pattern: "free", Replace: "$1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		in        string
+		direction string
+		out       string
+	}{
+		{"hi, my cat and your cat have 5 coins!", mobinthemiddle.DIRECTION_UPSTREAM, "hi, my dog and your dog have 50 coins."},
+		{"hello caterpillar, hi", mobinthemiddle.DIRECTION_DOWNSTREAM, "greetings dogerpillar, greetings"},
+		{"nothing here!", mobinthemiddle.DIRECTION_DOWNSTREAM, "nothing here!"},
+		{"all free", mobinthemiddle.DIRECTION_DOWNSTREAM, "all $1"},
+	} {
+		if out := rules.Rewrite(c.in, c.direction); out != c.out {
+			t.Errorf("Expected `%s` to become `%s` but got `%s`", c.in, c.out, out)
+		}
+	}
+
+	expected := map[string]uint64{"literal": 3, "regex": 1, "word": 2, "up": 1, "price": 1}
+	if hits := rules.Hits(); fmt.Sprint(hits) != fmt.Sprint(expected) {
+		t.Errorf("Expected hits %v but got %v", expected, hits)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rules := range [][]mobinthemiddle.Rule{
+		{{Match: mobinthemiddle.MATCH_REGEX, Pattern: "("}},
+		{{Match: mobinthemiddle.MATCH_LITERAL, Pattern: ""}},
+		{{Match: "fuzzy", Pattern: "x"}},
+		{{Match: mobinthemiddle.MATCH_LITERAL, Pattern: "x", Direction: "sideways"}},
+		{{Name: "a", Match: mobinthemiddle.MATCH_LITERAL, Pattern: "x"}, {Name: "a", Match: mobinthemiddle.MATCH_LITERAL, Pattern: "y"}},
+	} {
+		if _, err := mobinthemiddle.NewRules(rules); err == nil {
+			t.Errorf("Expected %v to be refused", rules)
+		}
+	}
+}
+
+func TestRulesAreReloaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"rules": [{"name": "swap", "match": "literal", "pattern": "a", "replace": "b"}]}`)
+
+	rules, err := mobinthemiddle.LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Watch(10 * time.Millisecond)
+	defer rules.Close()
+
+	waitFor := func(in string, out string) {
+		t.Helper()
+		for i := 0; rules.Rewrite(in, mobinthemiddle.DIRECTION_UPSTREAM) != out; i++ {
+			if i == 100 {
+				t.Fatalf("Expected `%s` to become `%s`", in, out)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("a", "b")
+
+	write(`{"rules": [{"name": "swap", "match": "literal", "pattern": "a", "replace": "c"}]}`)
+	waitFor("a", "c")
+
+	// Broken rules are ignored, and the ones in use kept
+	write(`{"rules": [{"name": "swap", "match": "regex", "pattern": "("}]}`)
+	time.Sleep(50 * time.Millisecond)
+	waitFor("a", "c")
+
+	// Counters are kept for rules with the same name
+	if hits := rules.Hits()["swap"]; hits < 2 {
+		t.Errorf("Expected the hits to be kept across reloads, but got %d", hits)
+	}
+}
+
+func TestRulesApplyPerDirection(t *testing.T) {
+	// Sends every line back
+	echo, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`{"rules": [
+		{"name": "up", "match": "word", "pattern": "foo", "replace": "bar", "direction": "upstream"},
+		{"name": "down", "match": "word", "pattern": "ping", "replace": "pong", "direction": "downstream"}
+	]}`), 0o644)
+
+	proxy, err := mobinthemiddle.ServeWithOptions("localhost:", echo.Addr().String(), mobinthemiddle.Options{RulesFile: path})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %s\n", err)
+	}
+	defer proxy.Close()
+
+	c, err := makeClient(proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Send("ping foo")
+	if msg, err := c.Recv(); err != nil || msg != "pong bar" {
+		t.Fatalf("Expected `pong bar` but got `%s` (%v)", msg, err)
+	}
+
+	hits := proxy.(interface{ RuleHits() map[string]uint64 }).RuleHits()
+	if hits["up"] != 1 || hits["down"] != 1 {
+		t.Errorf("Expected a hit for each rule but got %v", hits)
+	}
+}
+
 // A chat client
 type client struct {
 	net.Conn
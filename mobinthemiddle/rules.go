@@ -0,0 +1,303 @@
+package mobinthemiddle
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"protohackers/protos"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TONY_ADDRESS = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+const BOGUSCOIN_PATTERN = `7[a-zA-Z0-9]{25,34}`
+
+// What the proxy does without a rules file: send Boguscoin payments to Tony
+var DefaultRules = []Rule{
+	{Name: "boguscoin", Match: MATCH_WORD, Pattern: BOGUSCOIN_PATTERN, Replace: TONY_ADDRESS},
+}
+
+// How a rule finds what to replace
+const (
+	// Every occurrence of the pattern as is
+	MATCH_LITERAL = "literal"
+	// Every match of the pattern as a regular expression. The replacement
+	// can refer to submatches like regexp.Regexp.Expand does.
+	MATCH_REGEX = "regex"
+	// Every word, separated by spaces, that the pattern matches as a whole.
+	// The replacement is used as is.
+	MATCH_WORD = "word"
+)
+
+// Which lines a rule applies to
+const (
+	// From the client to the server
+	DIRECTION_UPSTREAM = protos.UPSTREAM
+	// From the server to the client
+	DIRECTION_DOWNSTREAM = protos.DOWNSTREAM
+	// Either way, which is what an empty direction means too
+	DIRECTION_BOTH = "both"
+)
+
+// How often the rules file is checked for changes, by default
+const DEFAULT_RULES_RELOAD_INTERVAL = time.Second
+
+// A rule rewriting the lines going through the proxy. Rules files are JSON
+// objects with a list of them under "rules":
+//
+//	{"rules": [
+//	  {"name": "boguscoin", "match": "word", "pattern": "7[a-zA-Z0-9]{25,34}",
+//	   "replace": "7YWHMfk9JZe0LM0g1ZauHuiSxhI", "direction": "both"}
+//	]}
+type Rule struct {
+	// Identifies the rule's hit counter, which is kept across reloads.
+	// Defaults to the rule's position, starting at 1.
+	Name      string `json:"name"`
+	Match     string `json:"match"`
+	Pattern   string `json:"pattern"`
+	Replace   string `json:"replace"`
+	Direction string `json:"direction,omitempty"`
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+	// Number of replacements made, shared with the rule of the same name
+	// in the rules loaded before
+	hits *uint64
+}
+
+// Replace the rule's matches in the line, counting them
+func (r *compiledRule) apply(line string) string {
+	switch r.Match {
+	case MATCH_LITERAL:
+		if n := strings.Count(line, r.Pattern); n > 0 {
+			atomic.AddUint64(r.hits, uint64(n))
+			return strings.ReplaceAll(line, r.Pattern, r.Replace)
+		}
+
+	case MATCH_REGEX:
+		if n := len(r.re.FindAllStringIndex(line, -1)); n > 0 {
+			atomic.AddUint64(r.hits, uint64(n))
+			return r.re.ReplaceAllString(line, r.Replace)
+		}
+
+	case MATCH_WORD:
+		words := strings.Split(line, " ")
+		for i, word := range words {
+			if r.re.MatchString(word) {
+				atomic.AddUint64(r.hits, 1)
+				words[i] = r.re.ReplaceAllLiteralString(word, r.Replace)
+			}
+		}
+		return strings.Join(words, " ")
+	}
+	return line
+}
+
+func (r *compiledRule) appliesTo(direction string) bool {
+	return r.Direction == DIRECTION_BOTH || r.Direction == direction
+}
+
+// Rules rewrite the lines going through the proxy, applying each rule in
+// turn to the lines going its way. They can be loaded from a file, and
+// reloaded whenever it changes.
+type Rules struct {
+	path string
+
+	// Guards rules, which are replaced as a whole on reload
+	mu    sync.RWMutex
+	rules []*compiledRule
+
+	// What the file looked like when last loaded, valid or not
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Use the given rules
+func NewRules(rules []Rule) (*Rules, error) {
+	compiled, err := compileRules(rules, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Rules{rules: compiled}, nil
+}
+
+// Load rules from a file, which can then be reloaded
+func LoadRules(path string) (*Rules, error) {
+	r := &Rules{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func compileRules(rules []Rule, previous []*compiledRule) ([]*compiledRule, error) {
+	hits := make(map[string]*uint64)
+	for _, r := range previous {
+		hits[r.Name] = r.hits
+	}
+
+	compiled := make([]*compiledRule, 0, len(rules))
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprint(i + 1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Duplicate rule `%s`", rule.Name)
+		}
+		names[rule.Name] = true
+
+		switch rule.Direction {
+		case "":
+			rule.Direction = DIRECTION_BOTH
+		case DIRECTION_UPSTREAM, DIRECTION_DOWNSTREAM, DIRECTION_BOTH:
+		default:
+			return nil, fmt.Errorf("Invalid direction `%s` for rule `%s`", rule.Direction, rule.Name)
+		}
+
+		c := &compiledRule{Rule: rule, hits: hits[rule.Name]}
+		if c.hits == nil {
+			c.hits = new(uint64)
+		}
+
+		var err error
+		switch rule.Match {
+		case MATCH_LITERAL:
+			if rule.Pattern == "" {
+				err = fmt.Errorf("empty pattern")
+			}
+		case MATCH_REGEX:
+			c.re, err = regexp.Compile(rule.Pattern)
+		case MATCH_WORD:
+			c.re, err = regexp.Compile(`^(?:` + rule.Pattern + `)$`)
+		default:
+			err = fmt.Errorf("invalid match `%s`", rule.Match)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule `%s`: %s", rule.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// Load the rules file again. The rules in use are kept if it's invalid.
+func (r *Rules) Reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("Failed to load rules: %s", err)
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("Failed to load rules: %s", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Whether it's valid or not, this version of the file was seen
+	r.modTime, r.size = info.ModTime(), info.Size()
+
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("Failed to load rules: %s", err)
+	}
+	compiled, err := compileRules(file.Rules, r.rules)
+	if err != nil {
+		return err
+	}
+	r.rules = compiled
+	return nil
+}
+
+// Reload the rules file whenever it changes, checking every so often, until
+// closed
+func (r *Rules) Watch(interval time.Duration) {
+	if r.path == "" || r.done != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DEFAULT_RULES_RELOAD_INTERVAL
+	}
+	r.done = make(chan struct{})
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					fmt.Printf("%s\n", err)
+				} else {
+					fmt.Printf("Reloaded rules from %s\n", r.path)
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// Whether the rules file looks different from when it was loaded
+func (r *Rules) changed() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+}
+
+// Stop watching the rules file
+func (r *Rules) Close() {
+	if r.done != nil {
+		close(r.done)
+		r.wg.Wait()
+	}
+}
+
+// Rewrite a line going the given way
+func (r *Rules) Rewrite(line string, direction string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.appliesTo(direction) {
+			line = rule.apply(line)
+		}
+	}
+	return line
+}
+
+// How many replacements each rule made so far, by name
+func (r *Rules) Hits() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hits := make(map[string]uint64, len(r.rules))
+	for _, rule := range r.rules {
+		hits[rule.Name] = atomic.LoadUint64(rule.hits)
+	}
+	return hits
+}
@@ -0,0 +1,28 @@
+package protos
+
+import "time"
+
+const (
+	MIN_BACKOFF = 5 * time.Millisecond
+	MAX_BACKOFF = time.Second
+)
+
+// Waits increasingly longer after consecutive errors that may well go away
+// on their own, such as running out of file descriptors, rather than
+// retrying in a busy loop.
+type backoff struct {
+	delay time.Duration
+}
+
+func (b *backoff) wait() {
+	if b.delay == 0 {
+		b.delay = MIN_BACKOFF
+	} else if b.delay *= 2; b.delay > MAX_BACKOFF {
+		b.delay = MAX_BACKOFF
+	}
+	time.Sleep(b.delay)
+}
+
+func (b *backoff) reset() {
+	b.delay = 0
+}
@@ -0,0 +1,354 @@
+// Package codec encodes and decodes the big-endian binary messages used by
+// several of the Protohackers problems.
+//
+// Messages are declared as plain structs and their layout is derived from
+// the field types, in declaration order:
+//
+//   - uint8/int8, uint16/int16, uint32/int32 and uint64/int64 are written as
+//     big-endian integers of the corresponding width.
+//   - Strings and slices are prefixed by their length, which is a u8 unless
+//     overridden with a `codec:"len=u16"` or `codec:"len=u32"` tag. Slices
+//     can't have more than MAX_PREALLOCATED elements.
+//   - Arrays are written element by element with no prefix.
+//   - Nested structs are written inline.
+//
+// Fields tagged with `codec:"-"` and unexported fields are ignored.
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The most bytes allocated for a string before they're read, longer ones
+// being grown as they arrive, as their length prefix comes from the stream
+// and can't be trusted. It's also the most elements a slice can have, as
+// elements taking no input at all would otherwise keep the decoder busy for
+// as long as the prefix says.
+const MAX_PREALLOCATED = 64 * 1024
+
+// A Decoder reads messages from an input stream.
+type Decoder struct {
+	r   io.Reader
+	buf [8]byte
+	// Bytes read so far of the message being decoded
+	read int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next message into the struct pointed to by v. It returns
+// io.EOF only if the stream ended before the message started, and
+// io.ErrUnexpectedEOF if it ended partway through.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("codec: Decode requires a non-nil pointer, got %T", v)
+	}
+
+	d.read = 0
+	err := d.decodeValue(rv.Elem(), 1)
+	if err == io.EOF && d.read > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Decoder) decodeValue(v reflect.Value, lenSize int) error {
+	switch v.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := d.readUint(int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size := int(v.Type().Size())
+		n, err := d.readUint(size)
+		if err != nil {
+			return err
+		}
+		// Sign-extend from the encoded width
+		shift := 64 - 8*size
+		v.SetInt(int64(n<<shift) >> shift)
+
+	case reflect.String:
+		n, err := d.readUint(lenSize)
+		if err != nil {
+			return err
+		}
+		b, err := d.readBytes(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+
+	case reflect.Slice:
+		n, err := d.readUint(lenSize)
+		if err != nil {
+			return err
+		}
+		if n > MAX_PREALLOCATED {
+			return fmt.Errorf("codec: slice length %d exceeds %d", n, MAX_PREALLOCATED)
+		}
+		// Grow the slice as elements arrive rather than trusting the length
+		s := reflect.MakeSlice(v.Type(), 0, int(n))
+		zero := reflect.Zero(v.Type().Elem())
+		for i := 0; i < int(n); i++ {
+			s = reflect.Append(s, zero)
+			if err := d.decodeValue(s.Index(i), 1); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.decodeValue(v.Index(i), 1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		info, err := getStructInfo(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, f := range info.fields {
+			if err := d.decodeValue(v.Field(f.index), f.lenSize); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("codec: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Read n bytes, allocating them as they arrive, so that a length prefix
+// can't make the decoder allocate more than the stream actually has
+func (d *Decoder) readBytes(n uint64) ([]byte, error) {
+	b := make([]byte, 0, min(n, MAX_PREALLOCATED))
+	for uint64(len(b)) < n {
+		start := len(b)
+		b = append(b, make([]byte, min(n-uint64(start), MAX_PREALLOCATED))...)
+		if err := d.readFull(b[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (d *Decoder) readFull(b []byte) error {
+	n, err := io.ReadFull(d.r, b)
+	d.read += n
+	return err
+}
+
+func min(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (d *Decoder) readUint(size int) (uint64, error) {
+	b := d.buf[:size]
+	if err := d.readFull(b); err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// An Encoder writes messages to an output stream.
+type Encoder struct {
+	w   io.Writer
+	buf [8]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the encoding of v, which must be a struct or a pointer to one.
+func (e *Encoder) Encode(v any) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("codec: Encode requires a struct, got %T", v)
+	}
+	return e.encodeValue(rv, 1)
+}
+
+func (e *Encoder) encodeValue(v reflect.Value, lenSize int) error {
+	switch v.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return e.writeUint(int(v.Type().Size()), v.Uint())
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeUint(int(v.Type().Size()), uint64(v.Int()))
+
+	case reflect.String:
+		if err := e.writeLength(lenSize, v.Len()); err != nil {
+			return err
+		}
+		_, err := io.WriteString(e.w, v.String())
+		return err
+
+	case reflect.Slice:
+		if v.Len() > MAX_PREALLOCATED {
+			return fmt.Errorf("codec: slice length %d exceeds %d", v.Len(), MAX_PREALLOCATED)
+		}
+		if err := e.writeLength(lenSize, v.Len()); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encodeValue(v.Index(i), 1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encodeValue(v.Index(i), 1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		info, err := getStructInfo(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, f := range info.fields {
+			if err := e.encodeValue(v.Field(f.index), f.lenSize); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("codec: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (e *Encoder) writeLength(size int, n int) error {
+	if uint64(n) > 1<<(8*size)-1 {
+		return fmt.Errorf("codec: length %d does not fit in a u%d prefix", n, 8*size)
+	}
+	return e.writeUint(size, uint64(n))
+}
+
+func (e *Encoder) writeUint(size int, n uint64) error {
+	b := e.buf[:size]
+
+	switch size {
+	case 1:
+		b[0] = uint8(n)
+	case 2:
+		binary.BigEndian.PutUint16(b, uint16(n))
+	case 4:
+		binary.BigEndian.PutUint32(b, uint32(n))
+	default:
+		binary.BigEndian.PutUint64(b, n)
+	}
+
+	_, err := e.w.Write(b)
+	return err
+}
+
+// Marshal returns the encoding of v.
+func Marshal(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes data into the struct pointed to by v. It's an error for
+// data to contain anything past the end of the message.
+func Unmarshal(data []byte, v any) error {
+	r := bytes.NewReader(data)
+	if err := NewDecoder(r).Decode(v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("codec: %d trailing bytes after message", r.Len())
+	}
+	return nil
+}
+
+type structInfo struct {
+	fields []fieldInfo
+}
+
+type fieldInfo struct {
+	index   int
+	lenSize int
+}
+
+// Field layouts are computed once per type, so that decoding into a reused
+// value doesn't allocate.
+var structCache sync.Map
+
+func getStructInfo(t reflect.Type) (*structInfo, error) {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo), nil
+	}
+
+	info := &structInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("codec")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+
+		lenSize := 1
+		if tag != "" {
+			if !strings.HasPrefix(tag, "len=") {
+				return nil, fmt.Errorf("codec: invalid tag %q on field %s", tag, f.Name)
+			}
+			width := strings.TrimPrefix(tag, "len=")
+			switch width {
+			case "u8":
+				lenSize = 1
+			case "u16":
+				lenSize = 2
+			case "u32":
+				lenSize = 4
+			default:
+				return nil, fmt.Errorf("codec: invalid length width %q on field %s", width, f.Name)
+			}
+		}
+
+		info.fields = append(info.fields, fieldInfo{index: i, lenSize: lenSize})
+	}
+
+	structCache.Store(t, info)
+	return info, nil
+}
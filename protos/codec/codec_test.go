@@ -0,0 +1,261 @@
+package codec_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"protohackers/protos/codec"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type plate struct {
+	Plate     string
+	Timestamp uint32
+}
+
+type ticket struct {
+	Plate      string
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Speed      uint16
+}
+
+type heartbeat struct {
+	Interval uint32
+	internal int
+	Ignored  string `codec:"-"`
+}
+
+type signed struct {
+	A int8
+	B int16
+	C int32
+	D int64
+}
+
+type nested struct {
+	Roads  []uint16
+	Long   string   `codec:"len=u16"`
+	Tags   []string `codec:"len=u32"`
+	Ticket ticket
+	Magic  [3]uint8
+}
+
+func TestEncodesFieldsInDeclarationOrder(t *testing.T) {
+	got, err := codec.Marshal(ticket{
+		Plate:      "UN1X",
+		Road:       66,
+		Mile1:      100,
+		Timestamp1: 123456,
+		Speed:      6000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{
+		0x04, 0x55, 0x4e, 0x31, 0x58,
+		0x00, 0x42,
+		0x00, 0x64,
+		0x00, 0x01, 0xe2, 0x40,
+		0x17, 0x70,
+	}
+	assertBytes(t, got, expected)
+}
+
+func TestSkipsUnexportedAndIgnoredFields(t *testing.T) {
+	got, err := codec.Marshal(&heartbeat{Interval: 10, internal: 3, Ignored: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, got, []byte{0, 0, 0, 10})
+}
+
+func TestRoundTrip(t *testing.T) {
+	testCases := []any{
+		&plate{Plate: "RE05BKG", Timestamp: 1000},
+		&signed{A: -1, B: -2, C: -3, D: -4},
+		&signed{A: 127, B: 32767, C: 2147483647, D: 1},
+		&nested{
+			Roads:  []uint16{1, 2, 3},
+			Long:   string(bytes.Repeat([]byte("a"), 300)),
+			Tags:   []string{"foo", "", "bar"},
+			Ticket: ticket{Plate: "X", Speed: 1},
+			Magic:  [3]uint8{7, 8, 9},
+		},
+	}
+
+	for _, original := range testCases {
+		data, err := codec.Marshal(original)
+		if err != nil {
+			t.Fatalf("Failed to encode %+v: %s", original, err)
+		}
+
+		decoded := reflect.New(reflect.TypeOf(original).Elem()).Interface()
+		err = codec.Unmarshal(data, decoded)
+		if err != nil {
+			t.Fatalf("Failed to decode %+v: %s", original, err)
+		}
+
+		if !reflect.DeepEqual(original, decoded) {
+			t.Errorf("Expected %+v but got %+v", original, decoded)
+		}
+	}
+}
+
+func TestDecodesConsecutiveMessagesFromStream(t *testing.T) {
+	stream := []byte{
+		0x03, 0x61, 0x62, 0x63, 0x00, 0x00, 0x00, 0x01,
+		0x01, 0x78, 0x00, 0x00, 0x00, 0x02,
+	}
+	d := codec.NewDecoder(bytes.NewReader(stream))
+
+	for _, expected := range []plate{{"abc", 1}, {"x", 2}} {
+		var p plate
+		if err := d.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p != expected {
+			t.Errorf("Expected %+v but got %+v", expected, p)
+		}
+	}
+
+	var p plate
+	if err := d.Decode(&p); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF at end of stream, got %v", err)
+	}
+}
+
+func TestRejectsTruncatedAndTrailingData(t *testing.T) {
+	var p plate
+
+	err := codec.Unmarshal([]byte{0x03, 0x61, 0x62}, &p)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF for truncated message, got %v", err)
+	}
+
+	err = codec.Unmarshal([]byte{0x00, 0x00, 0x00, 0x00, 0x01, 0xff}, &p)
+	if err == nil {
+		t.Errorf("Expected an error for trailing data")
+	}
+
+	// A stream ending between two fields isn't a clean end of stream
+	type message struct {
+		Kind  uint8
+		Value int32
+	}
+	err = codec.NewDecoder(bytes.NewReader([]byte{'I', 0, 0, 0, 1, 'Q'})).Decode(&message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = codec.NewDecoder(bytes.NewReader([]byte{'I'})).Decode(&message{})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF for a stream ending after a field, got %v", err)
+	}
+}
+
+func TestDoesNotTrustLengthPrefixes(t *testing.T) {
+	type long struct {
+		S string   `codec:"len=u32"`
+		L []uint64 `codec:"len=u32"`
+	}
+
+	for _, data := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 'a'},
+		{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := codec.Unmarshal(data, &long{})
+		runtime.ReadMemStats(&after)
+
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected unexpected EOF for %v, got %v", data, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*codec.MAX_PREALLOCATED*8 {
+			t.Errorf("Expected a truncated message not to allocate much, but it allocated %d bytes", allocated)
+		}
+	}
+}
+
+func TestRejectsSlicesOverTheLimit(t *testing.T) {
+	// Elements taking no input would otherwise be decoded for free
+	type empty struct {
+		L []struct{} `codec:"len=u32"`
+	}
+
+	start := time.Now()
+	err := codec.Unmarshal([]byte{0xff, 0xff, 0xff, 0xff}, &empty{})
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected an error for a slice over the limit, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the slice to be rejected right away, took %s", elapsed)
+	}
+
+	if _, err := codec.Marshal(empty{L: make([]struct{}, codec.MAX_PREALLOCATED+1)}); err == nil {
+		t.Errorf("Expected an error encoding a slice over the limit")
+	}
+	data, err := codec.Marshal(empty{L: make([]struct{}, codec.MAX_PREALLOCATED)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e empty
+	if err := codec.Unmarshal(data, &e); err != nil || len(e.L) != codec.MAX_PREALLOCATED {
+		t.Errorf("Expected a slice at the limit to round trip, got %d elements and %v", len(e.L), err)
+	}
+}
+
+func TestRejectsValuesThatDoNotFitTheLengthPrefix(t *testing.T) {
+	_, err := codec.Marshal(plate{Plate: string(make([]byte, 256))})
+	if err == nil {
+		t.Errorf("Expected an error for a string longer than 255 bytes")
+	}
+}
+
+func TestRejectsUnsupportedTypes(t *testing.T) {
+	type withFloat struct{ F float64 }
+	type badTag struct {
+		S string `codec:"len=u24"`
+	}
+
+	for _, v := range []any{withFloat{}, badTag{}} {
+		if _, err := codec.Marshal(v); err == nil {
+			t.Errorf("Expected an error encoding %T", v)
+		}
+	}
+
+	if err := codec.NewDecoder(bytes.NewReader(nil)).Decode(plate{}); err == nil {
+		t.Errorf("Expected an error decoding into a non-pointer")
+	}
+}
+
+func BenchmarkDecodeFixedWidth(b *testing.B) {
+	type message struct {
+		Kind   uint8
+		First  int32
+		Second int32
+	}
+	data := []byte{'I', 0, 0, 0x30, 0x39, 0, 0, 0, 0x65}
+	r := bytes.NewReader(data)
+	d := codec.NewDecoder(r)
+	msg := &message{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if err := d.Decode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func assertBytes(t *testing.T, got []byte, expected []byte) {
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %v but got %v", expected, got)
+	}
+}
@@ -0,0 +1,285 @@
+package protos
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Large enough for any UDP datagram
+const MAX_DATAGRAM_SIZE = 65535
+
+// Peers that haven't sent anything for this long are forgotten
+const DEFAULT_SESSION_TIMEOUT = time.Minute
+
+// PacketHandler handles the packets received by a PacketServer. Handlers are
+// only ever called from the goroutine running the server, one packet at a
+// time, and a packet is only valid until the handler returns.
+type PacketHandler interface {
+	HandlePacket(s *PacketSession, p []byte)
+}
+
+// SessionHandler can be implemented by packet handlers that want to know
+// when peers come and go, for instance to set up or clean their state.
+type SessionHandler interface {
+	SessionStarted(s *PacketSession)
+	SessionExpired(s *PacketSession)
+}
+
+// PacketFunc lets an ordinary function be used as a PacketHandler
+type PacketFunc func(s *PacketSession, p []byte)
+
+func (f PacketFunc) HandlePacket(s *PacketSession, p []byte) {
+	f(s, p)
+}
+
+type PacketOptions struct {
+	// Sessions expire after this long without packets from their peer.
+	// Defaults to DEFAULT_SESSION_TIMEOUT.
+	SessionTimeout time.Duration
+	// Maximum sustained number of packets per second accepted from a single
+	// peer, with bursts of up to Burst packets. Unlimited if zero.
+	Rate  float64
+	Burst int
+	// Larger packets are dropped. Unlimited if zero.
+	MaxPacketSize int
+}
+
+// Counters describing what a PacketServer has been up to
+type PacketMetrics struct {
+	// Every packet read, including dropped ones
+	Packets uint64
+	// Dropped for being over the size limit
+	Oversize uint64
+	// Dropped for coming from a peer over the rate limit
+	RateLimited uint64
+	// Currently tracked, and expired so far
+	Sessions        uint64
+	ExpiredSessions uint64
+}
+
+// PacketSession tracks a peer that has been sending packets to the server
+type PacketSession struct {
+	conn     net.PacketConn
+	addr     net.Addr
+	started  time.Time
+	lastSeen time.Time
+	limiter  *tokenBucket
+
+	// Anything the handler wants to keep about the peer
+	Data any
+}
+
+// Where the peer sends packets from
+func (s *PacketSession) Addr() net.Addr {
+	return s.addr
+}
+
+// When the first packet from the peer was received
+func (s *PacketSession) Started() time.Time {
+	return s.started
+}
+
+// When the last packet from the peer was received
+func (s *PacketSession) LastSeen() time.Time {
+	return s.lastSeen
+}
+
+// Send a packet to the peer. Unlike the rest of the session, this can be used
+// from any goroutine.
+func (s *PacketSession) Send(p []byte) error {
+	_, err := s.conn.WriteTo(p, s.addr)
+	return err
+}
+
+// PacketServer is a Server for protocols over UDP, keeping track of the peers
+// it hears from.
+type PacketServer struct {
+	// First, so that it's aligned for atomic access on 32-bit platforms
+	metrics PacketMetrics
+
+	net.PacketConn
+	handler  PacketHandler
+	opts     PacketOptions
+	sessions map[string]*PacketSession
+}
+
+func NewPacketServer(conn net.PacketConn, handler PacketHandler, opts PacketOptions) *PacketServer {
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = DEFAULT_SESSION_TIMEOUT
+	}
+
+	return &PacketServer{
+		PacketConn: conn,
+		handler:    handler,
+		opts:       opts,
+		sessions:   make(map[string]*PacketSession),
+	}
+}
+
+// Read packets from the connection and handle them with default options
+// until the connection is closed.
+func ServePacket(conn net.PacketConn, handler PacketHandler) {
+	NewPacketServer(conn, handler, PacketOptions{}).Serve()
+}
+
+func (s *PacketServer) Addr() net.Addr {
+	return s.PacketConn.LocalAddr()
+}
+
+func (s *PacketServer) Metrics() PacketMetrics {
+	return PacketMetrics{
+		Packets:         atomic.LoadUint64(&s.metrics.Packets),
+		Oversize:        atomic.LoadUint64(&s.metrics.Oversize),
+		RateLimited:     atomic.LoadUint64(&s.metrics.RateLimited),
+		Sessions:        atomic.LoadUint64(&s.metrics.Sessions),
+		ExpiredSessions: atomic.LoadUint64(&s.metrics.ExpiredSessions),
+	}
+}
+
+// Read packets from the connection and handle them one at a time until the
+// connection is closed.
+func (s *PacketServer) Serve() {
+	fmt.Println("Waiting for packets...")
+
+	p := make([]byte, MAX_DATAGRAM_SIZE)
+	var backoff backoff
+
+	// Reads are interrupted regularly to expire sessions, even when no
+	// packets are coming in
+	sweepInterval := s.opts.SessionTimeout / 2
+	nextSweep := time.Now().Add(sweepInterval)
+	s.SetReadDeadline(nextSweep)
+
+	for {
+		n, addr, err := s.ReadFrom(p)
+
+		if now := time.Now(); !now.Before(nextSweep) {
+			s.expireSessions(now)
+			nextSweep = now.Add(sweepInterval)
+			s.SetReadDeadline(nextSweep)
+		}
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Connection closed, exiting.\n")
+				break
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			fmt.Printf("Failed to read: %s\n", err)
+			backoff.wait()
+			continue
+		}
+		backoff.reset()
+
+		s.handle(p[:n], addr)
+	}
+}
+
+func (s *PacketServer) handle(p []byte, addr net.Addr) {
+	atomic.AddUint64(&s.metrics.Packets, 1)
+	if s.opts.MaxPacketSize > 0 && len(p) > s.opts.MaxPacketSize {
+		atomic.AddUint64(&s.metrics.Oversize, 1)
+		return
+	}
+
+	now := time.Now()
+	key := addr.String()
+	session, ok := s.sessions[key]
+	if !ok {
+		session = &PacketSession{
+			conn:    s.PacketConn,
+			addr:    addr,
+			started: now,
+			limiter: newTokenBucket(s.opts.Rate, s.opts.Burst),
+		}
+		s.sessions[key] = session
+		atomic.AddUint64(&s.metrics.Sessions, 1)
+		if h, ok := s.handler.(SessionHandler); ok {
+			h.SessionStarted(session)
+		}
+	}
+	session.lastSeen = now
+
+	if !session.limiter.allow(now) {
+		atomic.AddUint64(&s.metrics.RateLimited, 1)
+		return
+	}
+	s.handler.HandlePacket(session, p)
+}
+
+func (s *PacketServer) expireSessions(now time.Time) {
+	for key, session := range s.sessions {
+		if now.Sub(session.lastSeen) < s.opts.SessionTimeout {
+			continue
+		}
+		delete(s.sessions, key)
+		atomic.AddUint64(&s.metrics.Sessions, ^uint64(0))
+		atomic.AddUint64(&s.metrics.ExpiredSessions, 1)
+		if h, ok := s.handler.(SessionHandler); ok {
+			h.SessionExpired(session)
+		}
+	}
+}
+
+// A token bucket allowing `rate` events per second on average, in bursts of
+// up to `burst`. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Take a token even if there's none yet, returning how long until there
+// would have been one
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
@@ -0,0 +1,143 @@
+package protos_test
+
+import (
+	"net"
+	"protohackers/protos"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Replies to every packet with how many the peer has sent so far, and reports
+// expired sessions
+type countingHandler struct {
+	started chan net.Addr
+	expired chan net.Addr
+}
+
+func (h *countingHandler) HandlePacket(s *protos.PacketSession, p []byte) {
+	count := s.Data.(int) + 1
+	s.Data = count
+	s.Send([]byte(strconv.Itoa(count)))
+}
+
+func (h *countingHandler) SessionStarted(s *protos.PacketSession) {
+	s.Data = 0
+	h.started <- s.Addr()
+}
+
+func (h *countingHandler) SessionExpired(s *protos.PacketSession) {
+	h.expired <- s.Addr()
+}
+
+func startPacketServer(t *testing.T, opts protos.PacketOptions) (*protos.PacketServer, *countingHandler) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "localhost:")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s\n", err)
+	}
+	handler := &countingHandler{started: make(chan net.Addr, 10), expired: make(chan net.Addr, 10)}
+	server := protos.NewPacketServer(conn, handler, opts)
+	go server.Serve()
+	return server, handler
+}
+
+func dialPacketServer(t *testing.T, server *protos.PacketServer) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("udp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s\n", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func expectPacket(t *testing.T, conn net.Conn, expected string) {
+	t.Helper()
+
+	p := make([]byte, 100)
+	n, err := conn.Read(p)
+	if err != nil {
+		t.Fatalf("Expected `%s`, got error: %s", expected, err)
+	}
+	if string(p[:n]) != expected {
+		t.Fatalf("Expected `%s`, got `%s`", expected, p[:n])
+	}
+}
+
+func TestSessionsArePerPeer(t *testing.T) {
+	server, handler := startPacketServer(t, protos.PacketOptions{})
+	defer server.Close()
+
+	alice := dialPacketServer(t, server)
+	defer alice.Close()
+	bob := dialPacketServer(t, server)
+	defer bob.Close()
+
+	alice.Write([]byte("hi"))
+	expectPacket(t, alice, "1")
+	alice.Write([]byte("hi"))
+	expectPacket(t, alice, "2")
+	bob.Write([]byte("hi"))
+	expectPacket(t, bob, "1")
+
+	if addr := <-handler.started; addr.String() != alice.LocalAddr().String() {
+		t.Errorf("Expected a session for %s, got %s", alice.LocalAddr(), addr)
+	}
+	if m := server.Metrics(); m.Packets != 3 || m.Sessions != 2 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	server, handler := startPacketServer(t, protos.PacketOptions{SessionTimeout: 100 * time.Millisecond})
+	defer server.Close()
+
+	client := dialPacketServer(t, server)
+	defer client.Close()
+
+	client.Write([]byte("hi"))
+	expectPacket(t, client, "1")
+
+	select {
+	case addr := <-handler.expired:
+		if addr.String() != client.LocalAddr().String() {
+			t.Errorf("Expected the session for %s to expire, got %s", client.LocalAddr(), addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The session never expired")
+	}
+	if m := server.Metrics(); m.Sessions != 0 || m.ExpiredSessions != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// Coming back starts over
+	client.Write([]byte("hi"))
+	expectPacket(t, client, "1")
+}
+
+func TestPacketLimits(t *testing.T) {
+	server, _ := startPacketServer(t, protos.PacketOptions{MaxPacketSize: 5, Rate: 0.001, Burst: 2})
+	defer server.Close()
+
+	client := dialPacketServer(t, server)
+	defer client.Close()
+
+	client.Write([]byte("too long"))
+	client.Write([]byte("one"))
+	expectPacket(t, client, "1")
+	client.Write([]byte("two"))
+	expectPacket(t, client, "2")
+	client.Write([]byte("three"))
+
+	// Wait for the last packet to go through
+	deadline := time.Now().Add(time.Second)
+	for server.Metrics().RateLimited == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if m := server.Metrics(); m.Packets != 4 || m.Oversize != 1 || m.RateLimited != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
@@ -16,6 +16,7 @@ type Server interface {
 func Serve(listener net.Listener, handle ConnHandler) {
 	fmt.Println("Waiting for client...")
 
+	var backoff backoff
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -24,7 +25,10 @@ func Serve(listener net.Listener, handle ConnHandler) {
 				break
 			}
 			fmt.Printf("Failed to accept: %s\n", err)
+			backoff.wait()
+			continue
 		}
+		backoff.reset()
 		go handle(conn)
 	}
 }
@@ -0,0 +1,210 @@
+package protos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Which way lines are going through a proxy
+const (
+	// From the client to the server
+	UPSTREAM = "upstream"
+	// From the server to the client
+	DOWNSTREAM = "downstream"
+)
+
+// One way of a connection going through a proxy
+type ProxyStream struct {
+	Client    net.Addr
+	Direction string
+}
+
+// A Transformer handles the lines going one way through a connection,
+// returning the line to pass on, or false to drop it. It's only ever called
+// from one goroutine, and can take its time: lines wait for it.
+type Transformer interface {
+	Transform(line string) (string, bool)
+}
+
+// TransformerFunc lets an ordinary function be used as a Transformer
+type TransformerFunc func(line string) (string, bool)
+
+func (f TransformerFunc) Transform(line string) (string, bool) {
+	return f(line)
+}
+
+// A Stage sets up a transformer for each way of each connection, so that it
+// can keep state about it
+type Stage func(s ProxyStream) Transformer
+
+type ProxyOptions struct {
+	// What lines from the client go through before being sent to the server,
+	// in order. A line dropped by a stage doesn't reach the next ones.
+	Upstream []Stage
+	// What lines from the server go through before being sent to the client
+	Downstream []Stage
+}
+
+// ProxyServer relays line-based protocols between clients and a server,
+// passing the lines both ways through pipelines of transformers. Only
+// complete lines are relayed.
+type ProxyServer struct {
+	net.Listener
+	upstreamAddress string
+	opts            ProxyOptions
+}
+
+func ServeProxy(address string, upstreamAddress string, opts ProxyOptions) (*ProxyServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+
+	s := &ProxyServer{Listener: listener, upstreamAddress: upstreamAddress, opts: opts}
+	go Serve(listener, s.handle)
+
+	return s, nil
+}
+
+func (s *ProxyServer) handle(conn net.Conn) {
+	upstream, err := net.Dial("tcp", s.upstreamAddress)
+	if err != nil {
+		fmt.Printf("Error establishing a connection to upstream server: %s", err)
+		conn.Close()
+		return
+	}
+
+	client := conn.RemoteAddr()
+	go Pipe(conn, upstream, pipeline(s.opts.Upstream, ProxyStream{Client: client, Direction: UPSTREAM}))
+	go Pipe(upstream, conn, pipeline(s.opts.Downstream, ProxyStream{Client: client, Direction: DOWNSTREAM}))
+}
+
+// Set up the transformers for one way of a connection
+func pipeline(stages []Stage, stream ProxyStream) []Transformer {
+	transformers := make([]Transformer, len(stages))
+	for i, stage := range stages {
+		transformers[i] = stage(stream)
+	}
+	return transformers
+}
+
+// Relay complete lines from one side to the other, passing them through the
+// transformers in order. The destination is closed once the source is done,
+// and the source once the destination can't be written to.
+func Pipe(src io.ReadCloser, dst io.WriteCloser, transformers []Transformer) {
+	s := bufio.NewScanner(src)
+	s.Split(scanCompleteLines)
+
+lines:
+	for s.Scan() {
+		line := s.Text()
+		for _, t := range transformers {
+			var ok bool
+			if line, ok = t.Transform(line); !ok {
+				continue lines
+			}
+		}
+
+		if _, err := io.WriteString(dst, line+"\n"); err != nil {
+			src.Close()
+			return
+		}
+	}
+
+	dst.Close()
+}
+
+// A modification over the standard `ScanLines` that won't yield incomplete lines
+func scanCompleteLines(data []byte, atEOF bool) (int, []byte, error) {
+	// Stop and don't return anything if we hit EOF
+	if atEOF {
+		return 0, nil, nil
+	}
+
+	// For everything else, delegate to `bufio.ScanLines`
+	return bufio.ScanLines(data, atEOF)
+}
+
+// A stage rewriting lines with the given function
+func RewriteLines(rewrite func(line string, direction string) string) Stage {
+	return func(s ProxyStream) Transformer {
+		return TransformerFunc(func(line string) (string, bool) {
+			return rewrite(line, s.Direction), true
+		})
+	}
+}
+
+// A stage writing the lines going through it to a log, like
+// `127.0.0.1:1234 -> line` for lines from that client
+func LogLines(w io.Writer) Stage {
+	var mu sync.Mutex
+	return func(s ProxyStream) Transformer {
+		arrow := "->"
+		if s.Direction == DOWNSTREAM {
+			arrow = "<-"
+		}
+		return TransformerFunc(func(line string) (string, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(w, "%s %s %s\n", s.Client, arrow, line)
+			return line, true
+		})
+	}
+}
+
+// A line as recorded by RecordLines
+type RecordedLine struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Direction string    `json:"direction"`
+	Line      string    `json:"line"`
+}
+
+// A stage recording the lines going through it, as JSON objects one per line
+func RecordLines(w io.Writer) Stage {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(s ProxyStream) Transformer {
+		client := s.Client.String()
+		return TransformerFunc(func(line string) (string, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			encoder.Encode(RecordedLine{Time: time.Now(), Client: client, Direction: s.Direction, Line: line})
+			return line, true
+		})
+	}
+}
+
+// A stage holding lines back so that no more than `rate` go through every
+// second on each way of each connection, in bursts of up to `burst`
+func RateLimitLines(rate float64, burst int) Stage {
+	return func(s ProxyStream) Transformer {
+		bucket := newTokenBucket(rate, burst)
+		return TransformerFunc(func(line string) (string, bool) {
+			time.Sleep(bucket.reserve(time.Now()))
+			return line, true
+		})
+	}
+}
+
+// A stage holding every line back for the given delay, plus up to `jitter`
+// more picked at random
+func DelayLines(delay time.Duration, jitter time.Duration) Stage {
+	return func(s ProxyStream) Transformer {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return TransformerFunc(func(line string) (string, bool) {
+			d := delay
+			if jitter > 0 {
+				d += time.Duration(random.Int63n(int64(jitter)))
+			}
+			time.Sleep(d)
+			return line, true
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package protos_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"protohackers/protos"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a server sending every line back, and a proxy in front of it
+func startProxy(t *testing.T, opts protos.ProxyOptions) (*protos.ProxyServer, net.Conn, *bufio.Scanner) {
+	t.Helper()
+
+	echo, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s\n", err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	proxy, err := protos.ServeProxy("localhost:", echo.Addr().String(), opts)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %s\n", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return proxy, conn, bufio.NewScanner(conn)
+}
+
+// A writer that can be read from while the proxy writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProxyPipelines(t *testing.T) {
+	var log, record syncBuffer
+	dropSecrets := func(s protos.ProxyStream) protos.Transformer {
+		return protos.TransformerFunc(func(line string) (string, bool) {
+			return line, !strings.HasPrefix(line, "secret")
+		})
+	}
+	shout := protos.RewriteLines(func(line string, direction string) string {
+		if direction == protos.DOWNSTREAM {
+			return strings.ToUpper(line)
+		}
+		return line
+	})
+
+	_, conn, lines := startProxy(t, protos.ProxyOptions{
+		Upstream:   []protos.Stage{dropSecrets, protos.LogLines(&log)},
+		Downstream: []protos.Stage{shout, protos.RecordLines(&record)},
+	})
+	client := conn.LocalAddr().String()
+
+	fmt.Fprintf(conn, "hello\nsecret stuff\nbye\nincomplete")
+	for _, expected := range []string{"HELLO", "BYE"} {
+		if !lines.Scan() || lines.Text() != expected {
+			t.Fatalf("Expected `%s` but got `%s` (%v)", expected, lines.Text(), lines.Err())
+		}
+	}
+
+	expectedLog := fmt.Sprintf("%s -> hello\n%s -> bye\n", client, client)
+	if log.String() != expectedLog {
+		t.Errorf("Expected the log `%s` but got `%s`", expectedLog, log.String())
+	}
+
+	var recorded []string
+	for _, line := range strings.Split(strings.TrimSpace(record.String()), "\n") {
+		var r protos.RecordedLine
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Client != client || r.Direction != protos.DOWNSTREAM || r.Time.IsZero() {
+			t.Errorf("Unexpected record %+v", r)
+		}
+		recorded = append(recorded, r.Line)
+	}
+	if fmt.Sprint(recorded) != "[HELLO BYE]" {
+		t.Errorf("Expected the transformed lines to be recorded, but got %v", recorded)
+	}
+}
+
+func TestProxyRateLimitsAndDelays(t *testing.T) {
+	_, conn, lines := startProxy(t, protos.ProxyOptions{
+		Upstream:   []protos.Stage{protos.RateLimitLines(20, 2)},
+		Downstream: []protos.Stage{protos.DelayLines(50*time.Millisecond, 10*time.Millisecond)},
+	})
+
+	// Two lines go upstream at once and the next two every 50ms, while each
+	// line coming back waits 50ms or more after the one before it
+	start := time.Now()
+	fmt.Fprintf(conn, "1\n2\n3\n4\n")
+	for i := 1; i <= 4; i++ {
+		if !lines.Scan() || lines.Text() != fmt.Sprint(i) {
+			t.Fatalf("Expected `%d` but got `%s` (%v)", i, lines.Text(), lines.Err())
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the lines to take over 200ms, but they took %s", elapsed)
+	}
+}
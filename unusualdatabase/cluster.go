@@ -0,0 +1,300 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"protohackers/protos"
+	"protohackers/protos/codec"
+	"sync"
+	"time"
+)
+
+// Nodes can be linked into a cluster where changes made on any node end up
+// on every node. Linked nodes first present each other the secret shared by
+// the whole cluster, then send each other everything they have, and then
+// every change made on them as it happens, using the same records as the
+// write-ahead log. Changes carry a version, and conflicting ones are settled
+// by keeping the latest, so they can arrive in any order and more than once.
+// They're never relayed though, so every node has to be linked to every other
+// one, in either direction.
+//
+// Compare-and-swap is only atomic on the node it's made on, as two nodes can
+// swap the same value at the same time. The latest swap wins.
+
+// How many changes can be waiting to be sent to another node before the
+// link is considered broken. It's then brought up again by the node that
+// made it, with everything being sent over again.
+const PEER_QUEUE_SIZE = 10000
+
+const PEER_RECONNECT_DELAY = time.Second
+
+// How long a node has to present the secret once linked
+const PEER_HELLO_TIMEOUT = 10 * time.Second
+
+// Node names are sent with every change, prefixed by a u8 length
+const MAX_NODE_NAME_SIZE = 255
+
+// How long deleted keys are remembered, which is how late older changes to
+// them can arrive from other nodes without bringing them back
+const TOMBSTONE_LIFETIME = time.Hour
+
+type cluster struct {
+	name     string
+	secret   string
+	db       *database
+	listener net.Listener
+	done     chan struct{}
+
+	// Guards peers, closed and adding links to wg
+	mu     sync.Mutex
+	peers  map[*peer]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// The first thing linked nodes send each other
+type peerHello struct {
+	Secret string `codec:"len=u16"`
+}
+
+// A link to another node
+type peer struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+func randomNodeName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newCluster(db *database, opts Options) (*cluster, error) {
+	c := &cluster{
+		name:   opts.NodeName,
+		secret: opts.PeerSecret,
+		db:     db,
+		done:   make(chan struct{}),
+		peers:  make(map[*peer]bool),
+	}
+	if c.name == "" {
+		c.name = randomNodeName()
+	}
+
+	if opts.PeerAddress != "" {
+		listener, err := net.Listen("tcp", opts.PeerAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to listen: %s\n", err)
+		}
+		c.listener = listener
+		go protos.Serve(listener, func(conn net.Conn) { c.link(conn, false) })
+	}
+
+	for _, address := range opts.Peers {
+		c.wg.Add(1)
+		go c.dial(address)
+	}
+	return c, nil
+}
+
+// Keep a link to another node up until closed
+func (c *cluster) dial(address string) {
+	defer c.wg.Done()
+
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			fmt.Printf("Failed to connect to peer %s: %s\n", address, err)
+		} else {
+			c.link(conn, true)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(PEER_RECONNECT_DELAY):
+		}
+	}
+}
+
+// Exchange changes with another node until the link breaks
+func (c *cluster) link(conn net.Conn, dialed bool) {
+	r := bufio.NewReader(conn)
+	if err := c.hello(conn, r, dialed); err != nil {
+		fmt.Printf("Dropping link to peer %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	p := &peer{conn: conn, queue: make(chan []byte, PEER_QUEUE_SIZE)}
+	if !c.add(p) {
+		conn.Close()
+		return
+	}
+	defer c.wg.Done()
+	defer c.remove(p)
+
+	go c.send(p)
+
+	_, err := readRecords(r, func(r logRecord) {
+		// Changes from other nodes always have a version, and anything
+		// else would be taken for a local change
+		if r.Time != 0 {
+			c.db.apply(r, nil)
+		}
+	})
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Printf("Dropping link to peer %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// Present the secret to the other node and check theirs, so that nothing is
+// sent to or taken from a node outside the cluster. The node that made the
+// link goes first, so that the secret isn't given away to anyone connecting.
+func (c *cluster) hello(conn net.Conn, r *bufio.Reader, dialed bool) error {
+	conn.SetDeadline(time.Now().Add(PEER_HELLO_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	// Closing shouldn't have to wait for the timeout
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-c.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	if dialed {
+		if err := codec.NewEncoder(conn).Encode(&peerHello{Secret: c.secret}); err != nil {
+			return err
+		}
+	}
+	var hello peerHello
+	if err := codec.NewDecoder(r).Decode(&hello); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(c.secret)) != 1 {
+		return fmt.Errorf("Invalid secret")
+	}
+	if !dialed {
+		return codec.NewEncoder(conn).Encode(&peerHello{Secret: c.secret})
+	}
+	return nil
+}
+
+func (c *cluster) add(p *peer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.peers[p] = true
+	c.wg.Add(1)
+	return true
+}
+
+func (c *cluster) remove(p *peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.peers, p)
+	close(p.queue)
+	p.conn.Close()
+}
+
+// Send everything in the store to another node, then every change made here
+// until the link breaks. Changes made while the store is being sent are
+// queued, and may be sent twice, which is harmless.
+func (c *cluster) send(p *peer) {
+	w := bufio.NewWriter(p.conn)
+
+	var records []logRecord
+	c.db.store.each(func(key string, e entry) {
+		r := entryRecord(key, e)
+		// Values from before the node was in a cluster have the earliest
+		// version there is
+		if r.Time == 0 {
+			r.Time, r.Node = 1, c.name
+		}
+		records = append(records, r)
+	})
+	for _, r := range records {
+		buf, err := encodeRecord(r)
+		if err == nil {
+			_, err = w.Write(buf)
+		}
+		if err != nil {
+			p.conn.Close()
+			return
+		}
+	}
+
+	for {
+		if err := w.Flush(); err != nil {
+			p.conn.Close()
+			return
+		}
+		buf, ok := <-p.queue
+		if !ok {
+			return
+		}
+		// Write whatever else is waiting before flushing
+		for ok {
+			if _, err := w.Write(buf); err != nil {
+				p.conn.Close()
+				return
+			}
+			select {
+			case buf, ok = <-p.queue:
+			default:
+				ok = false
+			}
+		}
+	}
+}
+
+// Send a change made here to every other node
+func (c *cluster) replicate(r logRecord) {
+	buf, err := encodeRecord(r)
+	if err != nil {
+		fmt.Printf("Failed to replicate key `%s`: %s\n", r.Key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for p := range c.peers {
+		select {
+		case p.queue <- buf:
+		default:
+			fmt.Printf("Peer %s is too slow, dropping link\n", p.conn.RemoteAddr())
+			p.conn.Close()
+		}
+	}
+}
+
+// Drop every link and stop making new ones
+func (c *cluster) close() {
+	close(c.done)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+
+	c.mu.Lock()
+	c.closed = true
+	for p := range c.peers {
+		p.conn.Close()
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+}
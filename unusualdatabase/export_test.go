@@ -0,0 +1,11 @@
+package unusualdatabase
+
+import "runtime/debug"
+
+// Make the server see the given build info until the returned function is
+// called
+func SetBuildInfo(info *debug.BuildInfo, ok bool) func() {
+	old := readBuildInfo
+	readBuildInfo = func() (*debug.BuildInfo, bool) { return info, ok }
+	return func() { readBuildInfo = old }
+}
@@ -0,0 +1,200 @@
+package unusualdatabase
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.Extensions, requests starting with COMMAND_PREFIX are
+// commands rather than inserts or retrieves:
+//
+//	!del <key>                       delete the key, answered with `!del <key>=1`,
+//	                                 or `=0` if there was nothing to delete
+//	!ttl <duration> <key>=<value>    insert a value expiring after the duration,
+//	                                 such as `30s`, with no answer
+//	!cas <n> <key>=<old><new>        replace the value with <new> if it's <old>,
+//	                                 which is the first <n> bytes, answered with
+//	                                 `!cas <key>=1`, or `=0` if it wasn't
+//	!list <prefix>                   list the keys starting with the prefix
+//
+// The listing is split across as many responses as needed to stay within
+// MAX_PACKET_SIZE. Each is `!list <i>/<n> <prefix>=` followed by keys
+// separated by newlines, so that clients can tell when they have them all.
+// Over TCP, where responses are lines, each key has a response of its own.
+//
+// Keys starting with COMMAND_PREFIX are escaped by doubling it, and answered
+// that way too. Missing keys compare as empty, like they read, and reserved
+// keys can't be deleted, set or swapped any more than they can be inserted.
+const COMMAND_PREFIX = '!'
+
+const (
+	COMMAND_DELETE = "del"
+	COMMAND_TTL    = "ttl"
+	COMMAND_CAS    = "cas"
+	COMMAND_LIST   = "list"
+)
+
+// How often expired keys are dropped from the store
+const EXPIRY_SWEEP_INTERVAL = time.Second
+
+// An extended command, split into its parts
+type command struct {
+	name string
+	// The argument before the key, for the commands that have one
+	arg      string
+	key      []byte
+	value    []byte
+	isInsert bool
+}
+
+// Parse a command, without its prefix
+func parseCommand(msg []byte) (command, bool) {
+	name, rest, _ := bytes.Cut(msg, []byte{' '})
+	c := command{name: string(name)}
+
+	switch c.name {
+	case COMMAND_TTL, COMMAND_CAS:
+		arg, afterArg, ok := bytes.Cut(rest, []byte{' '})
+		if !ok {
+			return c, false
+		}
+		c.arg = string(arg)
+		rest = afterArg
+	case COMMAND_DELETE, COMMAND_LIST:
+	default:
+		return c, false
+	}
+
+	c.key, c.value, c.isInsert = cutPacket(rest)
+	return c, true
+}
+
+// Handle a command, without its prefix, appending the response to the given
+// buffer. Returns nil if there's nothing to respond, or if the responses were
+// sent already.
+func (db *database) handleCommand(msg []byte, response []byte, to responder) []byte {
+	c, ok := parseCommand(msg)
+	if !ok {
+		return nil
+	}
+	key := string(c.key)
+	_, reserved := db.reserved[key]
+
+	switch {
+	case c.name == COMMAND_DELETE && !c.isInsert:
+		deleted := !reserved && db.apply(logRecord{Op: OP_DELETE, Key: key}, keyExists)
+		return appendResult(response, c, deleted)
+
+	case c.name == COMMAND_TTL && c.isInsert:
+		ttl, err := time.ParseDuration(c.arg)
+		if err != nil || ttl <= 0 || reserved {
+			return nil
+		}
+		db.apply(logRecord{
+			Op:      OP_SET_EXPIRING,
+			Key:     key,
+			Value:   string(c.value),
+			Expires: time.Now().Add(ttl).UnixNano(),
+		}, nil)
+		return nil
+
+	case c.name == COMMAND_CAS && c.isInsert:
+		n, err := strconv.Atoi(c.arg)
+		if err != nil || n < 0 || n > len(c.value) {
+			return nil
+		}
+		old := string(c.value[:n])
+		// The new value doesn't expire, whether the old one did or not
+		swapped := !reserved && db.apply(logRecord{Op: OP_SET, Key: key, Value: string(c.value[n:])}, func(current entry, _ bool) bool {
+			return current.value == old
+		})
+		return appendResult(response, c, swapped)
+
+	case c.name == COMMAND_LIST && !c.isInsert:
+		db.list(key, response, to)
+		return nil
+	}
+	return nil
+}
+
+// Answer a command with whether it did anything
+func appendResult(response []byte, c command, ok bool) []byte {
+	response = append(response, COMMAND_PREFIX)
+	response = append(response, c.name...)
+	response = append(response, ' ')
+	response = append(response, c.key...)
+	if ok {
+		return append(response, "=1"...)
+	}
+	return append(response, "=0"...)
+}
+
+// Send the keys starting with the prefix to the client, using as many
+// responses as it takes. Responses that are lines have a key each.
+func (db *database) list(prefix string, buf []byte, to responder) {
+	keys := db.store.keys(prefix)
+
+	// Leave room for the header with the largest numbers it could have
+	header := func(i int, n int) string {
+		return fmt.Sprintf("%c%s %d/%d %s=", COMMAND_PREFIX, COMMAND_LIST, i, n, prefix)
+	}
+	most := len(keys)
+	if most == 0 {
+		most = 1
+	}
+	room := MAX_PACKET_SIZE - len(header(most, most))
+
+	var parts [][]string
+	var part []string
+	size := 0
+	for _, key := range keys {
+		if to.lines() {
+			parts = append(parts, []string{key})
+			continue
+		}
+		if len(key) > room {
+			// Too long to list with this prefix
+			atomic.AddUint64(&db.droppedResponses, 1)
+			continue
+		}
+		if len(part) > 0 && size+1+len(key) > room {
+			parts = append(parts, part)
+			part, size = nil, 0
+		}
+		if len(part) > 0 {
+			size++
+		}
+		part = append(part, key)
+		size += len(key)
+	}
+	if len(parts) == 0 || len(part) > 0 {
+		parts = append(parts, part)
+	}
+
+	for i, part := range parts {
+		buf = append(buf[:0], header(i+1, len(parts))...)
+		buf = append(buf, strings.Join(part, "\n")...)
+		to.respond(buf)
+	}
+}
+
+// Drop expired keys from the store until closed
+func (db *database) sweep() {
+	defer db.workers.Done()
+
+	ticker := time.NewTicker(EXPIRY_SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			db.store.expire(now)
+		case <-db.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package unusualdatabase
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The store can also be reached with a small HTTP API, where keys are the
+// rest of the path after KEYS_PATH:
+//
+//	GET    /keys/<key>        {"key": ..., "value": ...}, or 404 if there's no such key
+//	PUT    /keys/<key>        set the key from {"value": ..., "ttl": "30s"}, where the
+//	                          TTL is optional
+//	DELETE /keys/<key>        delete the key, or 404 if there's no such key
+//	GET    /keys?prefix=<p>   {"keys": [...]}, the keys starting with the prefix
+//
+// Keys and values go through the same checks as over UDP: reserved keys
+// can't be changed, keys can't have an equals sign, and a key and its value
+// can't take more than a packet. JSON being text, keys and values that
+// aren't valid UTF-8 can't be told apart from their replacement characters.
+const KEYS_PATH = "/keys/"
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type putRequest struct {
+	Value string `json:"value"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+type keyList struct {
+	Keys []string `json:"keys"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Start an HTTP server for the API
+func serveAPI(db *database, address string) (*http.Server, net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+
+	// Not a ServeMux, which would redirect paths it cleans up, as keys can
+	// have anything in them
+	httpServer := &http.Server{Handler: http.HandlerFunc(db.serveHTTP)}
+	go httpServer.Serve(listener)
+
+	return httpServer, listener, nil
+}
+
+func (db *database) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == strings.TrimSuffix(KEYS_PATH, "/") {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		keys := db.store.keys(r.URL.Query().Get("prefix"))
+		if keys == nil {
+			keys = []string{}
+		}
+		writeJSON(w, http.StatusOK, keyList{Keys: keys})
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, KEYS_PATH) {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	key := r.URL.Path[len(KEYS_PATH):]
+	if strings.Contains(key, "=") {
+		writeError(w, http.StatusBadRequest, "Keys can't have an equals sign")
+		return
+	}
+	_, reserved := db.reserved[key]
+
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := db.reserved[key]
+		if !ok {
+			value, ok = db.store.get(key)
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such key")
+			return
+		}
+		writeJSON(w, http.StatusOK, keyValue{Key: key, Value: value})
+
+	case http.MethodPut:
+		var req putRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_RECORD_SIZE)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, "Invalid TTL")
+				return
+			}
+		}
+		if reserved {
+			writeError(w, http.StatusForbidden, "Reserved key")
+			return
+		}
+		if len(key)+1+len(req.Value) > MAX_PACKET_SIZE {
+			writeError(w, http.StatusRequestEntityTooLarge, "Too large")
+			return
+		}
+
+		record := logRecord{Op: OP_SET, Key: key, Value: req.Value}
+		if ttl > 0 {
+			record.Op, record.Expires = OP_SET_EXPIRING, time.Now().Add(ttl).UnixNano()
+		}
+		db.apply(record, nil)
+		writeJSON(w, http.StatusOK, keyValue{Key: key, Value: req.Value})
+
+	case http.MethodDelete:
+		if reserved {
+			writeError(w, http.StatusForbidden, "Reserved key")
+			return
+		}
+		if !db.apply(logRecord{Op: OP_DELETE, Key: key}, keyExists) {
+			writeError(w, http.StatusNotFound, "No such key")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
@@ -0,0 +1,485 @@
+package unusualdatabase
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"protohackers/protos/codec"
+	"sync"
+	"time"
+)
+
+// When writes are flushed to disk
+type SyncPolicy int
+
+const (
+	// Sync every SyncInterval, which can lose that much on a crash
+	SyncPeriodically SyncPolicy = iota
+	// Sync before every write is applied, which is safe but slow
+	SyncEveryWrite
+	// Leave it to the operating system
+	SyncNever
+)
+
+// Files kept in the data directory
+const WAL_FILE_NAME = "wal"
+
+const SNAPSHOT_FILE_NAME = "snapshot"
+
+const DEFAULT_SYNC_INTERVAL = time.Second
+
+const DEFAULT_SNAPSHOT_INTERVAL = time.Minute
+
+// Size the log can grow to before being compacted into a snapshot
+const DEFAULT_COMPACTION_SIZE = 4 * 1024 * 1024
+
+// Operations recorded in the log
+const (
+	OP_SET = 's'
+	// Set a value that expires, at Expires nanoseconds since the Unix epoch
+	OP_SET_EXPIRING = 'e'
+	OP_DELETE       = 'd'
+)
+
+// Set on the operation of records carrying the version of the change, which
+// nodes of a cluster write so that changes win or lose against each other
+// the same way after a restart
+const OP_VERSIONED = 0x80
+
+// Every change to the store is appended to the write-ahead log as a record,
+// which is framed by its length and CRC-32 checksum so that a record that
+// was only partly written before a crash can be told apart. Snapshots are a
+// sequence of records too, one for each key.
+type logRecord struct {
+	Op    uint8
+	Key   string `codec:"len=u16"`
+	Value string `codec:"len=u16"`
+	// Only written for OP_SET_EXPIRING and versioned records, so that other
+	// records stay as they were before keys could expire
+	Expires int64 `codec:"-"`
+	// The version of the change, if it has one
+	Time int64  `codec:"-"`
+	Node string `codec:"-"`
+}
+
+// How OP_SET_EXPIRING records are written
+type expiringRecord struct {
+	Op      uint8
+	Key     string `codec:"len=u16"`
+	Value   string `codec:"len=u16"`
+	Expires int64
+}
+
+// How versioned records are written
+type versionedRecord struct {
+	Op      uint8
+	Key     string `codec:"len=u16"`
+	Value   string `codec:"len=u16"`
+	Expires int64
+	Time    int64
+	Node    string
+}
+
+// Length and checksum
+const RECORD_HEADER_SIZE = 8
+
+// writeAheadLog makes a store survive restarts. Writes are logged before
+// being applied, and the log is regularly compacted by writing a snapshot of
+// the whole store and starting it over.
+type writeAheadLog struct {
+	dir  string
+	opts Options
+
+	// Held for reading while a write is logged and applied, and for writing
+	// while taking a snapshot, so that no write ends up in the log after the
+	// snapshot was taken but missing from it.
+	mu sync.RWMutex
+
+	// Everything below is guarded by fileMu
+	fileMu sync.Mutex
+	file   *os.File
+	size   int64
+	// Whether there are writes that haven't been synced, or snapshotted
+	unsynced bool
+	changed  bool
+
+	compact chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Load the store kept in the directory, and start logging changes to it
+func openLog(opts Options, store *kvStore) (*writeAheadLog, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DEFAULT_SYNC_INTERVAL
+	}
+	if opts.SnapshotInterval <= 0 {
+		opts.SnapshotInterval = DEFAULT_SNAPSHOT_INTERVAL
+	}
+	if opts.CompactionSize <= 0 {
+		opts.CompactionSize = DEFAULT_COMPACTION_SIZE
+	}
+
+	if err := os.MkdirAll(opts.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("Failed to create data directory: %s", err)
+	}
+	l := &writeAheadLog{
+		dir:     opts.DataDir,
+		opts:    opts,
+		compact: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	if err := l.recover(store); err != nil {
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.maintain(store)
+
+	return l, nil
+}
+
+// Load the latest snapshot and replay the log on top of it. A record cut
+// short by a crash, and anything after it, is dropped from the log.
+func (l *writeAheadLog) recover(store *kvStore) error {
+	snapshot, err := os.Open(filepath.Join(l.dir, SNAPSHOT_FILE_NAME))
+	if err == nil {
+		_, err = readRecords(snapshot, func(r logRecord) { replayRecord(store, r) })
+		snapshot.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to load snapshot: %s", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to load snapshot: %s", err)
+	}
+
+	l.file, err = os.OpenFile(filepath.Join(l.dir, WAL_FILE_NAME), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Failed to open log: %s", err)
+	}
+
+	valid, err := readRecords(l.file, func(r logRecord) { replayRecord(store, r) })
+	if err != nil {
+		fmt.Printf("Discarding the end of the log after %d bytes: %s\n", valid, err)
+		if err := l.file.Truncate(valid); err != nil {
+			l.file.Close()
+			return fmt.Errorf("Failed to truncate log: %s", err)
+		}
+	}
+	l.size = valid
+	return nil
+}
+
+// Read records until the end of the input, returning how many bytes were
+// read up to the end of the last valid record
+func readRecords(r io.Reader, apply func(logRecord)) (int64, error) {
+	var valid int64
+	header := make([]byte, RECORD_HEADER_SIZE)
+	var payload []byte
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return valid, nil
+			}
+			return valid, err
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		checksum := binary.BigEndian.Uint32(header[4:])
+		if length > MAX_RECORD_SIZE {
+			return valid, fmt.Errorf("record too long: %d bytes", length)
+		}
+
+		if cap(payload) < int(length) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return valid, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return valid, fmt.Errorf("checksum mismatch")
+		}
+
+		record, err := decodeRecord(payload)
+		if err != nil {
+			return valid, err
+		}
+		apply(record)
+		valid += RECORD_HEADER_SIZE + int64(length)
+	}
+}
+
+// The largest a record can get, with the longest key and value a packet
+// can hold and then some
+const MAX_RECORD_SIZE = 64 * 1024
+
+func encodeRecord(r logRecord) ([]byte, error) {
+	var payload []byte
+	var err error
+	switch {
+	case r.Time != 0:
+		payload, err = codec.Marshal(&versionedRecord{
+			Op:      r.Op | OP_VERSIONED,
+			Key:     r.Key,
+			Value:   r.Value,
+			Expires: r.Expires,
+			Time:    r.Time,
+			Node:    r.Node,
+		})
+	case r.Op == OP_SET_EXPIRING:
+		payload, err = codec.Marshal(&expiringRecord{Op: r.Op, Key: r.Key, Value: r.Value, Expires: r.Expires})
+	default:
+		payload, err = codec.Marshal(&r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...), nil
+}
+
+func decodeRecord(payload []byte) (logRecord, error) {
+	if len(payload) == 0 {
+		return logRecord{}, fmt.Errorf("empty record")
+	}
+
+	switch {
+	case payload[0]&OP_VERSIONED != 0:
+		var v versionedRecord
+		err := codec.Unmarshal(payload, &v)
+		return logRecord{
+			Op:      v.Op &^ OP_VERSIONED,
+			Key:     v.Key,
+			Value:   v.Value,
+			Expires: v.Expires,
+			Time:    v.Time,
+			Node:    v.Node,
+		}, err
+	case payload[0] == OP_SET_EXPIRING:
+		var e expiringRecord
+		err := codec.Unmarshal(payload, &e)
+		return logRecord{Op: e.Op, Key: e.Key, Value: e.Value, Expires: e.Expires}, err
+	default:
+		var r logRecord
+		err := codec.Unmarshal(payload, &r)
+		return r, err
+	}
+}
+
+// Apply a record to the values of the shard its key belongs to
+func applyRecord(values map[string]entry, r logRecord) {
+	v := version{time: r.Time, node: r.Node}
+
+	switch r.Op {
+	case OP_SET:
+		values[r.Key] = entry{value: r.Value, version: v}
+	case OP_SET_EXPIRING:
+		values[r.Key] = entry{value: r.Value, expires: time.Unix(0, r.Expires), version: v}
+	case OP_DELETE:
+		if r.Time == 0 {
+			delete(values, r.Key)
+			return
+		}
+		// Remembered for a while, so that the deletion wins over older
+		// changes still on their way from other nodes
+		values[r.Key] = entry{
+			deleted: true,
+			expires: time.Unix(0, r.Time).Add(TOMBSTONE_LIFETIME),
+			version: v,
+		}
+	}
+}
+
+func replayRecord(store *kvStore, r logRecord) {
+	store.update(r.Key, func(values map[string]entry) { applyRecord(values, r) })
+}
+
+// The record setting a key to its current value, or deleting it
+func entryRecord(key string, e entry) logRecord {
+	r := logRecord{Op: OP_SET, Key: key, Value: e.value, Time: e.version.time, Node: e.version.node}
+	switch {
+	case e.deleted:
+		r.Op, r.Value = OP_DELETE, ""
+	case !e.expires.IsZero():
+		r.Op, r.Expires = OP_SET_EXPIRING, e.expires.UnixNano()
+	}
+	return r
+}
+
+func (l *writeAheadLog) append(r logRecord) error {
+	buf, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+
+	l.fileMu.Lock()
+	defer l.fileMu.Unlock()
+
+	if _, err := l.file.Write(buf); err != nil {
+		return fmt.Errorf("Failed to write to log: %s", err)
+	}
+	l.size += int64(len(buf))
+	l.changed = true
+
+	if l.opts.SyncPolicy == SyncEveryWrite {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("Failed to sync log: %s", err)
+		}
+	} else {
+		l.unsynced = true
+	}
+
+	if l.size >= l.opts.CompactionSize {
+		select {
+		case l.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Sync the log and take snapshots in the background until closed
+func (l *writeAheadLog) maintain(store *kvStore) {
+	defer l.wg.Done()
+
+	var syncs <-chan time.Time
+	if l.opts.SyncPolicy == SyncPeriodically {
+		ticker := time.NewTicker(l.opts.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	snapshots := time.NewTicker(l.opts.SnapshotInterval)
+	defer snapshots.Stop()
+
+	for {
+		var err error
+		select {
+		case <-syncs:
+			err = l.sync()
+		case <-snapshots.C:
+			err = l.snapshot(store)
+		case <-l.compact:
+			err = l.snapshot(store)
+		case <-l.done:
+			return
+		}
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		}
+	}
+}
+
+func (l *writeAheadLog) sync() error {
+	l.fileMu.Lock()
+	defer l.fileMu.Unlock()
+
+	if !l.unsynced {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync log: %s", err)
+	}
+	l.unsynced = false
+	return nil
+}
+
+// Write the whole store to a new snapshot, replacing the previous one, and
+// empty the log
+func (l *writeAheadLog) snapshot(store *kvStore) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fileMu.Lock()
+	defer l.fileMu.Unlock()
+
+	if !l.changed {
+		return nil
+	}
+
+	path := filepath.Join(l.dir, SNAPSHOT_FILE_NAME)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create snapshot: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	store.each(func(key string, e entry) {
+		if err != nil {
+			return
+		}
+		var buf []byte
+		buf, err = encodeRecord(entryRecord(key, e))
+		if err == nil {
+			_, err = tmp.Write(buf)
+		}
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err == nil {
+		err = syncDir(l.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write snapshot: %s", err)
+	}
+
+	// Everything in the log is in the snapshot now. Should we crash before
+	// the log is emptied, replaying it again on top of the snapshot is
+	// harmless.
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("Failed to truncate log: %s", err)
+	}
+	l.size = 0
+	l.changed = false
+	return nil
+}
+
+// Make a rename within the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Stop maintaining the log and flush it to disk. Closing again returns what
+// the first close did.
+func (l *writeAheadLog) close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+
+		l.fileMu.Lock()
+		defer l.fileMu.Unlock()
+
+		if err := l.file.Sync(); err != nil {
+			l.file.Close()
+			l.closeErr = fmt.Errorf("Failed to sync log: %s", err)
+			return
+		}
+		l.closeErr = l.file.Close()
+	})
+	return l.closeErr
+}
@@ -0,0 +1,65 @@
+package unusualdatabase
+
+import (
+	"runtime/debug"
+)
+
+// The key clients read the server's version from
+const VERSION_KEY = "version"
+
+// Reported when nothing better can be found in the build info
+const DEFAULT_VERSION = "devel"
+
+// Where the build info comes from, which tests replace
+var readBuildInfo = debug.ReadBuildInfo
+
+// Work out the version of the server from what the Go toolchain recorded when
+// building it: the module version if it was built as a dependency, or the
+// commit it was built from otherwise.
+func buildVersion() string {
+	info, ok := readBuildInfo()
+	if !ok {
+		return "unusualdatabase " + DEFAULT_VERSION
+	}
+
+	version := DEFAULT_VERSION
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if version == DEFAULT_VERSION && revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		version = revision
+		if modified {
+			version += "-dirty"
+		}
+	}
+
+	return "unusualdatabase " + version
+}
+
+// Keys clients can read but never write, along with their values. The
+// version is always among them.
+func reservedKeys(opts Options) map[string]string {
+	reserved := map[string]string{VERSION_KEY: opts.Version}
+	if opts.Version == "" {
+		reserved[VERSION_KEY] = buildVersion()
+	}
+	for key, value := range opts.Reserved {
+		if key != VERSION_KEY {
+			reserved[key] = value
+		}
+	}
+	return reserved
+}
@@ -0,0 +1,143 @@
+package unusualdatabase
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of independently locked parts the store is split into
+const SHARD_COUNT = 64
+
+// kvStore is a key-value store that can be used from many goroutines at once.
+// Keys are spread across shards, each with its own lock, so that requests for
+// different keys rarely wait on each other.
+type kvStore struct {
+	shards [SHARD_COUNT]shard
+}
+
+type shard struct {
+	mu     sync.RWMutex
+	values map[string]entry
+}
+
+// A value, and when it expires if it ever does
+type entry struct {
+	value   string
+	expires time.Time
+	// Only kept in a cluster, where a deleted key is remembered for a while
+	deleted bool
+	version version
+}
+
+// When a change was made and on which node, in a cluster. The change with
+// the latest version wins, whatever the order changes arrive in.
+type version struct {
+	time int64
+	node string
+}
+
+func (v version) after(other version) bool {
+	if v.time != other.time {
+		return v.time > other.time
+	}
+	return v.node > other.node
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func newKVStore() *kvStore {
+	s := &kvStore{}
+	for i := range s.shards {
+		s.shards[i].values = make(map[string]entry)
+	}
+	return s
+}
+
+// Get the value under a key, unless there's none or it has expired
+func (s *kvStore) get(key string) (string, bool) {
+	sh := &s.shards[shardIndex(key)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.values[key]
+	if !ok || e.deleted || e.expired(time.Now()) {
+		return "", false
+	}
+	return e.value, true
+}
+
+// Call the function with the values of the key's shard, locked for writing,
+// so that it can check and change the key's value at once
+func (s *kvStore) update(key string, f func(values map[string]entry)) {
+	sh := &s.shards[shardIndex(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	f(sh.values)
+}
+
+// Which shard a key belongs to
+func shardIndex[T string | []byte](key T) int {
+	return int(keyHash(key) % SHARD_COUNT)
+}
+
+// The 32-bit FNV-1a hash of a key. Taking the key as bytes lets callers hash
+// part of a packet without turning it into a string first.
+func keyHash[T string | []byte](key T) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// Call the function for every key that hasn't expired, including deleted
+// ones, one shard at a time
+func (s *kvStore) each(f func(key string, e entry)) {
+	now := time.Now()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.values {
+			if !e.expired(now) {
+				f(key, e)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// The keys starting with the prefix that haven't expired, in order
+func (s *kvStore) keys(prefix string) []string {
+	var keys []string
+	s.each(func(key string, e entry) {
+		if !e.deleted && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Drop the keys that have expired, returning how many there were. Expired
+// keys are never seen anyway, this only frees the memory they take.
+func (s *kvStore) expire(now time.Time) int {
+	expired := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for key, e := range sh.values {
+			if e.expired(now) {
+				delete(sh.values, key)
+				expired++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return expired
+}
@@ -0,0 +1,178 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"protohackers/protos"
+	"sync"
+)
+
+// The store can also be reached over TCP, with the same requests as over
+// UDP, one per line, and the same responses, one per line too. Lines longer
+// than MAX_PACKET_SIZE are ignored like oversize packets, so that whatever
+// is stored over TCP can be read over UDP.
+//
+// As keys and values can have newlines in them when they come from anywhere
+// else, newlines, carriage returns and backslashes are escaped both ways,
+// as \n, \r and \\. Any other backslash is taken as it is.
+type lineServer struct {
+	db       *database
+	listener net.Listener
+
+	// Guards conns, closed and adding connections to wg
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func serveLines(db *database, address string) (*lineServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %s\n", err)
+	}
+
+	s := &lineServer{db: db, listener: listener, conns: make(map[net.Conn]bool)}
+	go protos.Serve(listener, s.handleConnection)
+	return s, nil
+}
+
+func (s *lineServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	if !s.add(conn) {
+		return
+	}
+	defer s.remove(conn)
+
+	reader := bufio.NewReaderSize(conn, MAX_PACKET_SIZE+2)
+	to := &lineResponder{w: bufio.NewWriter(conn)}
+	buf := make([]byte, 0, MAX_PACKET_SIZE)
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of a line that's too long
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+		if len(line) > MAX_PACKET_SIZE {
+			continue
+		}
+
+		line = unescapeLine(line)
+		if response := s.db.handle(line, buf[:0], to); response != nil {
+			to.respond(response)
+			buf = response
+		}
+		if to.err != nil {
+			return
+		}
+		// Let responses pile up while requests do
+		if reader.Buffered() == 0 {
+			if err := to.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *lineServer) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *lineServer) remove(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// Stop accepting clients, disconnect everyone and wait until they're gone
+func (s *lineServer) close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Undo the escaping of a request, in place as it only ever gets shorter
+func unescapeLine(line []byte) []byte {
+	n := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			switch line[i+1] {
+			case 'n':
+				c = '\n'
+				i++
+			case 'r':
+				c = '\r'
+				i++
+			case '\\':
+				i++
+			}
+		}
+		line[n] = c
+		n++
+	}
+	return line[:n]
+}
+
+// Responds to a TCP client with a line for each response
+type lineResponder struct {
+	w *bufio.Writer
+	// The first error writing, after which the client is gone
+	err error
+}
+
+func (r *lineResponder) respond(p []byte) {
+	for _, c := range p {
+		if r.err != nil {
+			return
+		}
+		switch c {
+		case '\n':
+			_, r.err = r.w.WriteString(`\n`)
+		case '\r':
+			_, r.err = r.w.WriteString(`\r`)
+		case '\\':
+			_, r.err = r.w.WriteString(`\\`)
+		default:
+			r.err = r.w.WriteByte(c)
+		}
+	}
+	if r.err == nil {
+		r.err = r.w.WriteByte('\n')
+	}
+}
+
+func (r *lineResponder) lines() bool {
+	return true
+}
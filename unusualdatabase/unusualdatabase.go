@@ -1,60 +1,493 @@
 package unusualdatabase
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"protohackers/protos"
-	"strings"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Requests and responses never take more than this. Larger requests are
+// dropped, as are responses that would be larger.
+const MAX_PACKET_SIZE = 1000
+
+// How many packets can be waiting for each worker before reading stalls
+const WORKER_QUEUE_SIZE = 64
+
+type Options struct {
+	// Number of goroutines handling requests. Defaults to the number of CPUs.
+	Workers int
+	// Maximum sustained number of requests per second from a single client,
+	// with bursts of up to Burst requests. Unlimited if zero.
+	Rate  float64
+	Burst int
+
+	// If set, the store is kept in this directory and survives restarts
+	DataDir string
+	// When writes are flushed to disk, and how often if periodically.
+	// Defaults to DEFAULT_SYNC_INTERVAL.
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	// How often a snapshot is taken, if anything changed. Defaults to
+	// DEFAULT_SNAPSHOT_INTERVAL.
+	SnapshotInterval time.Duration
+	// How large the log can grow before a snapshot is taken early. Defaults
+	// to DEFAULT_COMPACTION_SIZE.
+	CompactionSize int64
+
+	// What clients get when reading the version key. Derived from the build
+	// info if empty.
+	Version string
+	// Other keys clients can read but not write, and their values
+	Reserved map[string]string
+
+	// Accept the extended commands, for deleting keys, setting keys that
+	// expire, compare-and-swap and listing keys. Requests starting with
+	// COMMAND_PREFIX are then commands, and keys starting with it need it
+	// doubled.
+	Extensions bool
+
+	// Name of the node within a cluster, random if empty, and no longer
+	// than MAX_NODE_NAME_SIZE. Ties between changes made at the same time are
+	// settled by node name.
+	NodeName string
+	// Shared by every node in the cluster, which have to present it to each
+	// other before anything else. Required to be part of a cluster.
+	PeerSecret string
+	// If set, other nodes can link to this one on this TCP address
+	PeerAddress string
+	// Nodes to link to, on their peer address. Setting either makes the node
+	// part of a cluster.
+	Peers []string
+
+	// If set, the store can also be reached over TCP on this address, with
+	// the same requests as over UDP, one per line
+	TCPAddress string
+	// If set, the store can also be reached with an HTTP API on this address
+	HTTPAddress string
+}
+
 func Serve(address string) (protos.Server, error) {
+	return ServeWithOptions(address, Options{})
+}
+
+func ServeWithOptions(address string, opts Options) (protos.Server, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if len(opts.NodeName) > MAX_NODE_NAME_SIZE {
+		return nil, fmt.Errorf("Node name is longer than %d bytes", MAX_NODE_NAME_SIZE)
+	}
+	if (opts.PeerAddress != "" || len(opts.Peers) > 0) && opts.PeerSecret == "" {
+		return nil, fmt.Errorf("A peer secret is required to be part of a cluster")
+	}
+
 	conn, err := net.ListenPacket("udp", address)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to listen: %s\n", err)
 	}
 
+	db := &database{
+		conn:       conn,
+		store:      newKVStore(),
+		reserved:   reservedKeys(opts),
+		extensions: opts.Extensions,
+		done:       make(chan struct{}),
+	}
+	s := &server{db: db}
+
+	if opts.DataDir != "" {
+		db.log, err = openLog(opts, db.store)
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+	if opts.PeerAddress != "" || len(opts.Peers) > 0 {
+		db.cluster, err = newCluster(db, opts)
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+	if opts.TCPAddress != "" {
+		s.lines, err = serveLines(db, opts.TCPAddress)
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+	if opts.HTTPAddress != "" {
+		s.api, s.apiListener, err = serveAPI(db, opts.HTTPAddress)
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+
+	// Packets are handed to workers by key, so requests for the same key are
+	// handled one after the other in the order they arrived. That keeps the
+	// last write the one that wins, however many workers there are.
+	db.queues = make([]chan packet, opts.Workers)
+	db.handled = make([]uint64, opts.Workers)
+	for i := range db.queues {
+		db.queues[i] = make(chan packet, WORKER_QUEUE_SIZE)
+		db.workers.Add(1)
+		go db.work(i)
+	}
+
+	// Expiring keys can only be set with extensions, but deleted keys are
+	// remembered until they expire in a cluster
+	if opts.Extensions || db.cluster != nil {
+		db.workers.Add(1)
+		go db.sweep()
+	}
+
+	packets := protos.NewPacketServer(conn, db, protos.PacketOptions{
+		Rate:          opts.Rate,
+		Burst:         opts.Burst,
+		MaxPacketSize: MAX_PACKET_SIZE,
+	})
 	go func() {
-		kvStore := make(map[string]string)
-		p := make([]byte, 1000)
+		packets.Serve()
+		for _, q := range db.queues {
+			close(q)
+		}
+	}()
+
+	s.PacketServer = packets
+	return s, nil
+}
+
+type server struct {
+	*protos.PacketServer
+	db *database
+
+	lines       *lineServer
+	api         *http.Server
+	apiListener net.Listener
+
+	closeOnce sync.Once
+}
+
+// The address TCP clients can connect to, if enabled
+func (s *server) TCPAddr() net.Addr {
+	if s.lines == nil {
+		return nil
+	}
+	return s.lines.listener.Addr()
+}
+
+// The address of the HTTP API, if enabled
+func (s *server) HTTPAddr() net.Addr {
+	if s.apiListener == nil {
+		return nil
+	}
+	return s.apiListener.Addr()
+}
+
+// Where other nodes can link to this one, or nil if they can't
+func (s *server) PeerAddr() net.Addr {
+	if s.db.cluster == nil || s.db.cluster.listener == nil {
+		return nil
+	}
+	return s.db.cluster.listener.Addr()
+}
+
+type Stats struct {
+	// Every request received, including dropped ones
+	Requests uint64
+	// Requests over MAX_PACKET_SIZE
+	DroppedRequests uint64
+	// Requests from clients over the rate limit
+	RateLimited uint64
+	// Responses that would have been over MAX_PACKET_SIZE
+	DroppedResponses uint64
+	// Clients heard from recently
+	Clients uint64
+	// Requests handled by each worker
+	WorkerRequests []uint64
+}
 
-		for {
-			n, addr, err := conn.ReadFrom(p)
-			if err != nil {
-				fmt.Printf("Failed to read: %s\n", err)
+func (s *server) Stats() Stats {
+	m := s.Metrics()
+	return Stats{
+		Requests:         m.Packets,
+		DroppedRequests:  m.Oversize,
+		RateLimited:      m.RateLimited,
+		DroppedResponses: atomic.LoadUint64(&s.db.droppedResponses),
+		Clients:          m.Sessions,
+		WorkerRequests:   s.db.workerRequests(),
+	}
+}
+
+// Stop serving, and once the requests already received have been handled,
+// flush the store to disk if it's kept there. Closing again only reports that
+// the connection is already closed.
+func (s *server) Close() error {
+	err := s.PacketConn.Close()
+	s.closeOnce.Do(func() {
+		close(s.db.done)
+		s.closeFrontends()
+		if s.db.cluster != nil {
+			s.db.cluster.close()
+		}
+		s.db.workers.Wait()
+		if s.db.log != nil {
+			if logErr := s.db.log.close(); err == nil {
+				err = logErr
 			}
+		}
+	})
+	return err
+}
+
+// Undo whatever was started when failing to start the server
+func (s *server) abort() {
+	s.db.conn.Close()
+	s.closeFrontends()
+	if s.db.cluster != nil {
+		s.db.cluster.close()
+	}
+	if s.db.log != nil {
+		s.db.log.close()
+	}
+}
+
+// Stop the TCP and HTTP servers, waiting for the requests they're handling
+func (s *server) closeFrontends() {
+	if s.lines != nil {
+		s.lines.close()
+	}
+	if s.api != nil {
+		s.api.Shutdown(context.Background())
+	}
+}
+
+// Buffers packets are copied into while waiting for a worker, reused once
+// they've been handled
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, MAX_PACKET_SIZE)
+		return &buf
+	},
+}
+
+type packet struct {
+	buf  *[]byte
+	n    int
+	addr net.Addr
+}
+
+type database struct {
+	// First, so that it's aligned for atomic access on 32-bit platforms
+	droppedResponses uint64
 
-			msg := string(p[:n])
+	conn  net.PacketConn
+	store *kvStore
+	// Only if the store is kept on disk
+	log        *writeAheadLog
+	reserved   map[string]string
+	extensions bool
+	// Only if the node is part of a cluster
+	cluster *cluster
+
+	queues []chan packet
+	// Requests handled by each worker, in the same order as the queues
+	handled []uint64
+
+	workers sync.WaitGroup
+	done    chan struct{}
+}
+
+func (db *database) workerRequests() []uint64 {
+	handled := make([]uint64, len(db.handled))
+	for i := range handled {
+		handled[i] = atomic.LoadUint64(&db.handled[i])
+	}
+	return handled
+}
+
+// Hand a packet over to the worker in charge of its key
+func (db *database) HandlePacket(s *protos.PacketSession, p []byte) {
+	buf := bufferPool.Get().(*[]byte)
+	n := copy(*buf, p)
+	key := db.routingKey(p)
+	// The whole hash rather than the shard, so that every worker gets some
+	// keys however many there are
+	db.queues[keyHash(key)%uint32(len(db.queues))] <- packet{buf: buf, n: n, addr: s.Addr()}
+}
 
-			// Insert
-			if strings.Contains(msg, "=") {
-				kvPair := strings.SplitN(msg, "=", 2)
-				key, value := kvPair[0], kvPair[1]
-				fmt.Printf("Storing value `%s` under key `%s`\n", value, key)
-				kvStore[key] = value
-				continue
+func (db *database) work(worker int) {
+	defer db.workers.Done()
+
+	// Responses are built in the same buffer every time
+	buf := make([]byte, 0, MAX_PACKET_SIZE)
+	to := &datagramResponder{db: db}
+
+	for p := range db.queues[worker] {
+		atomic.AddUint64(&db.handled[worker], 1)
+		to.addr = p.addr
+		response := db.handle((*p.buf)[:p.n], buf[:0], to)
+		bufferPool.Put(p.buf)
+
+		if response != nil {
+			to.respond(response)
+			buf = response
+		}
+	}
+}
+
+// Where the responses to a client's requests go
+type responder interface {
+	respond(p []byte)
+	// Whether responses are lines, which can't have newlines in them
+	lines() bool
+}
+
+// Responds to a UDP client with a datagram for each response
+type datagramResponder struct {
+	db   *database
+	addr net.Addr
+}
+
+func (r *datagramResponder) respond(p []byte) {
+	if len(p) > MAX_PACKET_SIZE {
+		atomic.AddUint64(&r.db.droppedResponses, 1)
+		return
+	}
+	r.db.conn.WriteTo(p, r.addr)
+}
+
+func (r *datagramResponder) lines() bool {
+	return false
+}
+
+// Handle a request, appending the response to the given buffer. Returns nil
+// if there's nothing to respond, or if the responses were sent already.
+func (db *database) handle(msg []byte, response []byte, to responder) []byte {
+	if db.extensions && len(msg) > 0 && msg[0] == COMMAND_PREFIX {
+		if len(msg) < 2 || msg[1] != COMMAND_PREFIX {
+			return db.handleCommand(msg[1:], response, to)
+		}
+		// An escaped key, answered the way it was asked for
+		response = append(response, COMMAND_PREFIX)
+		msg = msg[1:]
+	}
+
+	key, value, isInsert := cutPacket(msg)
+
+	// Insert, ignored for reserved keys
+	if isInsert {
+		if _, ok := db.reserved[string(key)]; !ok {
+			db.set(string(key), string(value))
+		}
+		return nil
+	}
+
+	// Retrieve
+	response = append(response, key...)
+	response = append(response, '=')
+
+	if reserved, ok := db.reserved[string(key)]; ok {
+		return append(response, reserved...)
+	}
+
+	stored, _ := db.store.get(string(key))
+	return append(response, stored...)
+}
+
+func (db *database) set(key string, value string) {
+	db.apply(logRecord{Op: OP_SET, Key: key, Value: value}, nil)
+}
+
+// Log a change if the store is kept on disk, and apply it. If there's a
+// check, the change is only made if it passes given the key's current value,
+// with the key's shard locked in between so that nothing can change it.
+//
+// In a cluster, changes made here are given a version and sent to the other
+// nodes, while changes from other nodes already have one and are only made
+// if it's later than the version of the key's current value.
+//
+// Returns whether the change was made.
+func (db *database) apply(r logRecord, check func(current entry, ok bool) bool) bool {
+	if db.log != nil {
+		db.log.mu.RLock()
+		defer db.log.mu.RUnlock()
+	}
+
+	local := r.Time == 0
+	applied := false
+	db.store.update(r.Key, func(values map[string]entry) {
+		stored, exists := values[r.Key]
+		if check != nil {
+			current, ok := stored, exists
+			if ok && (current.deleted || current.expired(time.Now())) {
+				current, ok = entry{}, false
 			}
-			// Retrieve
-			var response []byte
-
-			// Version
-			if msg == "version" {
-				response = []byte("version=v1.0")
-			} else {
-				response = []byte(msg + "=" + kvStore[msg])
+			if !check(current, ok) {
+				return
+			}
+		}
+
+		switch {
+		case local && db.cluster != nil:
+			// Later than whatever the key had, even if the clock went back
+			r.Time = time.Now().UnixNano()
+			if r.Time <= stored.version.time {
+				r.Time = stored.version.time + 1
 			}
+			r.Node = db.cluster.name
+		case !local && !(version{time: r.Time, node: r.Node}).after(stored.version):
+			return
+		}
 
-			fmt.Printf("Requesting value for key `%s`, responding with `%s`\n", msg, response)
-			conn.WriteTo(response, addr)
+		if db.log != nil {
+			if err := db.log.append(r); err != nil {
+				fmt.Printf("Failed to store value under key `%s`: %s\n", r.Key, err)
+				return
+			}
 		}
-	}()
+		applyRecord(values, r)
+		applied = true
+	})
 
-	return &server{PacketConn: conn}, nil
+	if applied && local && db.cluster != nil {
+		db.cluster.replicate(r)
+	}
+	return applied
 }
 
-type server struct {
-	net.PacketConn
+// A check for apply, passing if the key has a value
+func keyExists(_ entry, ok bool) bool {
+	return ok
 }
 
-func (s *server) Addr() net.Addr {
-	return s.PacketConn.LocalAddr()
+// The key a request is about, which decides the worker handling it
+func (db *database) routingKey(p []byte) []byte {
+	if db.extensions && len(p) > 0 && p[0] == COMMAND_PREFIX {
+		if len(p) > 1 && p[1] == COMMAND_PREFIX {
+			p = p[1:]
+		} else if c, ok := parseCommand(p[1:]); ok {
+			return c.key
+		}
+	}
+	key, _, _ := cutPacket(p)
+	return key
+}
+
+// Split a packet into its key and value. Anything without an equals sign is
+// a retrieve request for the whole packet.
+func cutPacket(msg []byte) ([]byte, []byte, bool) {
+	i := bytes.IndexByte(msg, '=')
+	if i < 0 {
+		return msg, nil, false
+	}
+	return msg[:i], msg[i+1:], true
 }
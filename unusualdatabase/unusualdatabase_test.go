@@ -1,9 +1,20 @@
 package unusualdatabase_test
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"protohackers/protos"
 	"protohackers/unusualdatabase"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,6 +97,872 @@ func TestVersionAlreadyExistsAndCannotBeOverwritten(t *testing.T) {
 	assertPacket(t, string(version), p)
 }
 
+func TestVersionIsDerivedFromBuildInfo(t *testing.T) {
+	vcs := func(revision string, modified string) []debug.BuildSetting {
+		return []debug.BuildSetting{{Key: "vcs.revision", Value: revision}, {Key: "vcs.modified", Value: modified}}
+	}
+
+	for _, c := range []struct {
+		info     *debug.BuildInfo
+		expected string
+	}{
+		{&debug.BuildInfo{Main: debug.Module{Version: "v1.2.3"}, Settings: vcs("0123456789abcdef", "false")}, "unusualdatabase v1.2.3"},
+		{&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}, Settings: vcs("0123456789abcdef", "false")}, "unusualdatabase 0123456789ab"},
+		{&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}, Settings: vcs("0123456789abcdef", "true")}, "unusualdatabase 0123456789ab-dirty"},
+		{&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, "unusualdatabase devel"},
+		{nil, "unusualdatabase devel"},
+	} {
+		restore := unusualdatabase.SetBuildInfo(c.info, c.info != nil)
+		server, err := unusualdatabase.Serve("localhost:")
+		restore()
+		if err != nil {
+			t.Fatalf("Failed to start server: %s\n", err)
+		}
+
+		client, err := StartUDPClient(server.Addr().String())
+		if err != nil {
+			t.Fatalf("Error starting UDP client for testing: %s", err)
+		}
+		client.SendPacket([]byte("version"))
+		assertPacket(t, "version="+c.expected, client.ReadPacket())
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestReservedKeysCannotBeWritten(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{
+		Version:  "1.2.3",
+		Reserved: map[string]string{"motd": "hello"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+
+	client.SendPacket([]byte("version=hacked"))
+	client.SendPacket([]byte("motd=hacked"))
+	client.SendPacket([]byte("version"))
+	assertPacket(t, "version=1.2.3", client.ReadPacket())
+	client.SendPacket([]byte("motd"))
+	assertPacket(t, "motd=hello", client.ReadPacket())
+}
+
+func TestOversizePacketsAreDropped(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{
+		Reserved: map[string]string{"big": strings.Repeat("x", 997)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+	stats := server.(interface{ Stats() unusualdatabase.Stats })
+
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+
+	// Exactly at the limit is fine
+	key := strings.Repeat("k", 500)
+	insert(t, client, key+"="+strings.Repeat("v", 499))
+
+	client.SendPacket([]byte(key + "=" + strings.Repeat("v", 500)))
+	client.SendPacket([]byte(key))
+	assertPacket(t, key+"="+strings.Repeat("v", 499), client.ReadPacket())
+
+	client.SendPacket([]byte("big"))
+	assertPacket(t, "", client.ReadPacket())
+
+	s := stats.Stats()
+	if s.DroppedRequests != 1 || s.DroppedResponses != 1 {
+		t.Errorf("Expected one dropped request and response, got %+v", s)
+	}
+}
+
+func TestClosingTheServerStopsIt(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{Workers: 4})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close server: %s", err)
+	}
+
+	// Nothing keeps reading from the closed socket
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("Expected %d goroutines after closing, got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClosingTwice(t *testing.T) {
+	server, client := startPersistent(t, unusualdatabase.Options{DataDir: t.TempDir()})
+	insert(t, client, "foo=bar")
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close server: %s", err)
+	}
+	if err := server.Close(); err == nil {
+		t.Errorf("Expected closing again to fail")
+	}
+}
+
+func TestClientsAreRateLimited(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{Rate: 1, Burst: 5})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+	stats := server.(interface{ Stats() unusualdatabase.Stats })
+
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		client.SendPacket([]byte("foo"))
+	}
+	received := 0
+	for len(client.ReadPacket()) > 0 {
+		received++
+	}
+	if received != 5 {
+		t.Errorf("Expected 5 responses within the burst, got %d", received)
+	}
+
+	s := stats.Stats()
+	if s.Requests != 10 || s.RateLimited != 5 || s.Clients != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestLastWriteWins(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{Workers: 8})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		client.SendPacket([]byte(fmt.Sprintf("counter=%d", i)))
+	}
+	client.SendPacket([]byte("counter"))
+	assertPacket(t, "counter=99", client.ReadPacket())
+}
+
+func TestManyConcurrentClients(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{Workers: 8})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			client, err := StartUDPClient(server.Addr().String())
+			if err != nil {
+				t.Errorf("Error starting UDP client for testing: %s", err)
+				return
+			}
+			defer client.Close()
+
+			for j := 0; j < 10; j++ {
+				key := fmt.Sprintf("client%d-key%d", i, j)
+				client.SendPacket([]byte(key + "=" + key))
+				client.SendPacket([]byte(key))
+				if p := client.ReadPacket(); string(p) != key+"="+key {
+					t.Errorf("Expected `%s=%s` but got `%s`", key, key, p)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMoreWorkersThanShards(t *testing.T) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{Workers: 4 * unusualdatabase.SHARD_COUNT})
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2000; i++ {
+		insert(t, client, fmt.Sprintf("key%d=%d", i, i))
+	}
+
+	// Keys are spread over every worker, not just as many as there are shards
+	handled := server.(interface{ Stats() unusualdatabase.Stats }).Stats().WorkerRequests
+	if len(handled) != 4*unusualdatabase.SHARD_COUNT {
+		t.Fatalf("Expected a count for each worker, got %d", len(handled))
+	}
+	for i, n := range handled {
+		if n == 0 {
+			t.Errorf("Expected worker %d to handle some requests", i)
+		}
+	}
+}
+
+// Insert values and wait until they're stored, by reading them back
+func insert(t *testing.T, client *UDPClient, pairs ...string) {
+	t.Helper()
+	for _, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		client.SendPacket([]byte(pair))
+		client.SendPacket([]byte(key))
+		assertPacket(t, pair, client.ReadPacket())
+	}
+}
+
+func startPersistent(t *testing.T, opts unusualdatabase.Options) (protos.Server, *UDPClient) {
+	t.Helper()
+	server, err := unusualdatabase.ServeWithOptions("localhost:", opts)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s\n", err)
+	}
+	client, err := StartUDPClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error starting UDP client for testing: %s", err)
+	}
+	return server, client
+}
+
+func TestStoreSurvivesRestarts(t *testing.T) {
+	for _, policy := range []unusualdatabase.SyncPolicy{
+		unusualdatabase.SyncPeriodically,
+		unusualdatabase.SyncEveryWrite,
+		unusualdatabase.SyncNever,
+	} {
+		opts := unusualdatabase.Options{DataDir: t.TempDir(), SyncPolicy: policy}
+
+		server, client := startPersistent(t, opts)
+		insert(t, client, "foo=bar", "key=value", "foo=baz")
+		server.Close()
+		client.Close()
+
+		server, client = startPersistent(t, opts)
+		client.SendPacket([]byte("foo"))
+		assertPacket(t, "foo=baz", client.ReadPacket())
+		client.SendPacket([]byte("key"))
+		assertPacket(t, "key=value", client.ReadPacket())
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestRecoveryDropsRecordCutShort(t *testing.T) {
+	opts := unusualdatabase.Options{DataDir: t.TempDir()}
+
+	server, client := startPersistent(t, opts)
+	insert(t, client, "first=1", "second=2", "third=3")
+	server.Close()
+	client.Close()
+
+	// As if the server crashed halfway through writing the last record
+	wal := filepath.Join(opts.DataDir, unusualdatabase.WAL_FILE_NAME)
+	info, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client = startPersistent(t, opts)
+	client.SendPacket([]byte("second"))
+	assertPacket(t, "second=2", client.ReadPacket())
+	client.SendPacket([]byte("third"))
+	assertPacket(t, "third=", client.ReadPacket())
+
+	// What's written next isn't lost behind the broken record
+	insert(t, client, "fourth=4")
+	server.Close()
+	client.Close()
+
+	server, client = startPersistent(t, opts)
+	defer server.Close()
+	defer client.Close()
+	client.SendPacket([]byte("first"))
+	assertPacket(t, "first=1", client.ReadPacket())
+	client.SendPacket([]byte("fourth"))
+	assertPacket(t, "fourth=4", client.ReadPacket())
+}
+
+func TestLogIsCompactedIntoSnapshots(t *testing.T) {
+	opts := unusualdatabase.Options{DataDir: t.TempDir(), CompactionSize: 256}
+
+	server, client := startPersistent(t, opts)
+	for i := 0; i < 50; i++ {
+		insert(t, client, fmt.Sprintf("key%d=%d", i%10, i))
+	}
+
+	snapshot := filepath.Join(opts.DataDir, unusualdatabase.SNAPSHOT_FILE_NAME)
+	for i := 0; ; i++ {
+		if _, err := os.Stat(snapshot); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("No snapshot was taken")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Close()
+	client.Close()
+
+	info, err := os.Stat(filepath.Join(opts.DataDir, unusualdatabase.WAL_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 512 {
+		t.Errorf("Expected the log to be compacted, but it has %d bytes", info.Size())
+	}
+
+	server, client = startPersistent(t, opts)
+	defer server.Close()
+	defer client.Close()
+	for i := 40; i < 50; i++ {
+		client.SendPacket([]byte(fmt.Sprintf("key%d", i%10)))
+		assertPacket(t, fmt.Sprintf("key%d=%d", i%10, i), client.ReadPacket())
+	}
+}
+
+func startExtended(t *testing.T, opts unusualdatabase.Options) (protos.Server, *UDPClient) {
+	t.Helper()
+	opts.Extensions = true
+	return startPersistent(t, opts)
+}
+
+func TestExtensionsAreOptIn(t *testing.T) {
+	server, client := startPersistent(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	insert(t, client, "!del foo=bar")
+	client.SendPacket([]byte("!list "))
+	assertPacket(t, "!list =", client.ReadPacket())
+}
+
+func TestDeleteCommand(t *testing.T) {
+	server, client := startExtended(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	insert(t, client, "foo=bar")
+	client.SendPacket([]byte("!del foo"))
+	assertPacket(t, "!del foo=1", client.ReadPacket())
+	client.SendPacket([]byte("!del foo"))
+	assertPacket(t, "!del foo=0", client.ReadPacket())
+	client.SendPacket([]byte("foo"))
+	assertPacket(t, "foo=", client.ReadPacket())
+
+	client.SendPacket([]byte("!del version"))
+	assertPacket(t, "!del version=0", client.ReadPacket())
+}
+
+func TestKeysExpire(t *testing.T) {
+	server, client := startExtended(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	client.SendPacket([]byte("!ttl 100ms short=lived"))
+	client.SendPacket([]byte("!ttl 1h long=lived"))
+	client.SendPacket([]byte("!ttl 1h version=0"))
+	client.SendPacket([]byte("short"))
+	assertPacket(t, "short=lived", client.ReadPacket())
+
+	time.Sleep(150 * time.Millisecond)
+	client.SendPacket([]byte("short"))
+	assertPacket(t, "short=", client.ReadPacket())
+	client.SendPacket([]byte("long"))
+	assertPacket(t, "long=lived", client.ReadPacket())
+	client.SendPacket([]byte("!list "))
+	assertPacket(t, "!list 1/1 =long", client.ReadPacket())
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	server, client := startExtended(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	// Missing keys compare as empty
+	client.SendPacket([]byte("!cas 0 counter=1"))
+	assertPacket(t, "!cas counter=1", client.ReadPacket())
+	client.SendPacket([]byte("!cas 1 counter=12"))
+	assertPacket(t, "!cas counter=1", client.ReadPacket())
+	client.SendPacket([]byte("!cas 1 counter=13"))
+	assertPacket(t, "!cas counter=0", client.ReadPacket())
+	client.SendPacket([]byte("counter"))
+	assertPacket(t, "counter=2", client.ReadPacket())
+
+	// Malformed commands are ignored
+	client.SendPacket([]byte("!cas 5 counter=2"))
+	client.SendPacket([]byte("!cas counter=2"))
+	client.SendPacket([]byte("counter"))
+	assertPacket(t, "counter=2", client.ReadPacket())
+}
+
+func TestEscapedKeys(t *testing.T) {
+	server, client := startExtended(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	insert(t, client, "!!bang=value")
+	client.SendPacket([]byte("!list !"))
+	assertPacket(t, "!list 1/1 !=!bang", client.ReadPacket())
+	client.SendPacket([]byte("!del !bang"))
+	assertPacket(t, "!del !bang=1", client.ReadPacket())
+	client.SendPacket([]byte("!!bang"))
+	assertPacket(t, "!!bang=", client.ReadPacket())
+}
+
+func TestListingIsSplitAcrossPackets(t *testing.T) {
+	server, client := startExtended(t, unusualdatabase.Options{})
+	defer server.Close()
+	defer client.Close()
+
+	var expected []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("long/%02d/%s", i, strings.Repeat("x", 100))
+		insert(t, client, key+"=")
+		expected = append(expected, key)
+	}
+	insert(t, client, "other=")
+
+	client.SendPacket([]byte("!list long/"))
+	// The first response says how many there are
+	var keys []string
+	for part, parts := 1, 1; part <= parts; part++ {
+		p := client.ReadPacket()
+		if len(p) > unusualdatabase.MAX_PACKET_SIZE {
+			t.Fatalf("Got a %d bytes response", len(p))
+		}
+		if part == 1 {
+			fmt.Sscanf(string(p), "!list 1/%d ", &parts)
+		}
+		header, listed, _ := strings.Cut(string(p), "=")
+		if header != fmt.Sprintf("!list %d/%d long/", part, parts) {
+			t.Fatalf("Unexpected response `%s`", p)
+		}
+		keys = append(keys, strings.Split(listed, "\n")...)
+	}
+	if strings.Join(keys, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the keys %v but got %v", expected, keys)
+	}
+}
+
+func TestExtensionsSurviveRestarts(t *testing.T) {
+	opts := unusualdatabase.Options{DataDir: t.TempDir()}
+
+	server, client := startExtended(t, opts)
+	insert(t, client, "deleted=1", "swapped=1")
+	client.SendPacket([]byte("!ttl 1h expiring=1"))
+	client.SendPacket([]byte("!ttl 10ms expired=1"))
+	client.SendPacket([]byte("!del deleted"))
+	assertPacket(t, "!del deleted=1", client.ReadPacket())
+	client.SendPacket([]byte("!cas 1 swapped=12"))
+	assertPacket(t, "!cas swapped=1", client.ReadPacket())
+	server.Close()
+	client.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	server, client = startExtended(t, opts)
+	defer server.Close()
+	defer client.Close()
+	client.SendPacket([]byte("!list "))
+	assertPacket(t, "!list 1/1 =expiring\nswapped", client.ReadPacket())
+	client.SendPacket([]byte("swapped"))
+	assertPacket(t, "swapped=2", client.ReadPacket())
+}
+
+// Start nodes linked to every other one, each with a client
+func startCluster(t *testing.T, n int, opts unusualdatabase.Options) ([]protos.Server, []*UDPClient) {
+	t.Helper()
+	var servers []protos.Server
+	var clients []*UDPClient
+	var peers []string
+	for i := 0; i < n; i++ {
+		opts.NodeName = fmt.Sprintf("node%d", i)
+		opts.PeerSecret = "secret"
+		opts.PeerAddress = "localhost:"
+		opts.Peers = peers
+		server, client := startPersistent(t, opts)
+		t.Cleanup(func() {
+			server.Close()
+			client.Close()
+		})
+		servers = append(servers, server)
+		clients = append(clients, client)
+		peers = append(peers, server.(interface{ PeerAddr() net.Addr }).PeerAddr().String())
+	}
+	return servers, clients
+}
+
+// Read a key until it has the expected value
+func waitForValue(t *testing.T, client *UDPClient, pair string) {
+	t.Helper()
+	key, _, _ := strings.Cut(pair, "=")
+	var p []byte
+	for i := 0; i < 100; i++ {
+		client.SendPacket([]byte(key))
+		if p = client.ReadPacket(); string(p) == pair {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected `%s` but got `%s`", pair, p)
+}
+
+func TestClusterReplicatesWrites(t *testing.T) {
+	_, clients := startCluster(t, 3, unusualdatabase.Options{Version: "1.0"})
+
+	for i, client := range clients {
+		client.SendPacket([]byte(fmt.Sprintf("from%d=%d", i, i)))
+	}
+	for _, client := range clients {
+		for i := range clients {
+			waitForValue(t, client, fmt.Sprintf("from%d=%d", i, i))
+		}
+	}
+
+	// Reserved keys are left alone
+	clients[0].SendPacket([]byte("version=2.0"))
+	clients[1].SendPacket([]byte("version"))
+	assertPacket(t, "version=1.0", clients[1].ReadPacket())
+}
+
+func TestClusterSettlesOnTheLatestWrite(t *testing.T) {
+	_, clients := startCluster(t, 3, unusualdatabase.Options{})
+
+	for round := 0; round < 10; round++ {
+		for i, client := range clients {
+			client.SendPacket([]byte(fmt.Sprintf("key=%d/%d", round, i)))
+		}
+	}
+
+	// Whatever write came last, every node ends up with it
+	for i := 0; ; i++ {
+		var values []string
+		for _, client := range clients {
+			client.SendPacket([]byte("key"))
+			values = append(values, string(client.ReadPacket()))
+		}
+		if values[0] == values[1] && values[1] == values[2] {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Nodes disagree on the value: %v", values)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	insert(t, clients[2], "key=last")
+	for _, client := range clients {
+		waitForValue(t, client, "key=last")
+	}
+}
+
+func TestNodesCatchUpWhenJoining(t *testing.T) {
+	first, client := startPersistent(t, unusualdatabase.Options{PeerSecret: "secret", PeerAddress: "localhost:"})
+	defer first.Close()
+	defer client.Close()
+	insert(t, client, "early=1", "early=2")
+
+	second, late := startPersistent(t, unusualdatabase.Options{
+		PeerSecret: "secret",
+		Peers:      []string{first.(interface{ PeerAddr() net.Addr }).PeerAddr().String()},
+	})
+	defer second.Close()
+	defer late.Close()
+	waitForValue(t, late, "early=2")
+}
+
+func TestClusterLinksTakeTheSecret(t *testing.T) {
+	if _, err := unusualdatabase.ServeWithOptions("localhost:", unusualdatabase.Options{PeerAddress: "localhost:"}); err == nil {
+		t.Fatalf("Expected a cluster without a secret to be refused")
+	}
+
+	first, client := startPersistent(t, unusualdatabase.Options{PeerSecret: "secret", PeerAddress: "localhost:"})
+	defer first.Close()
+	defer client.Close()
+	insert(t, client, "private=1")
+	peerAddr := first.(interface{ PeerAddr() net.Addr }).PeerAddr().String()
+
+	// Anyone else linking gets nothing, not even the secret, and can't write
+	conn, err := net.Dial("tcp", peerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0, 5, 'w', 'r', 'o', 'n', 'g'})
+	if data, _ := io.ReadAll(conn); len(data) != 0 {
+		t.Errorf("Expected nothing from a link with the wrong secret, got %q", data)
+	}
+
+	second, other := startPersistent(t, unusualdatabase.Options{PeerSecret: "wrong", Peers: []string{peerAddr}})
+	defer second.Close()
+	defer other.Close()
+	insert(t, other, "intruder=1")
+	time.Sleep(100 * time.Millisecond)
+	other.SendPacket([]byte("private"))
+	assertPacket(t, "private=", other.ReadPacket())
+	client.SendPacket([]byte("intruder"))
+	assertPacket(t, "intruder=", client.ReadPacket())
+}
+
+func TestNodeNamesMustFitInRecords(t *testing.T) {
+	opts := unusualdatabase.Options{
+		NodeName:    strings.Repeat("n", unusualdatabase.MAX_NODE_NAME_SIZE+1),
+		PeerSecret:  "secret",
+		PeerAddress: "localhost:",
+	}
+	if _, err := unusualdatabase.ServeWithOptions("localhost:", opts); err == nil {
+		t.Fatalf("Expected a node name over %d bytes to be refused", unusualdatabase.MAX_NODE_NAME_SIZE)
+	}
+
+	opts.NodeName = opts.NodeName[1:]
+	server, client := startPersistent(t, opts)
+	defer server.Close()
+	defer client.Close()
+	insert(t, client, "key=value")
+}
+
+func TestClusterReplicatesDeletes(t *testing.T) {
+	_, clients := startCluster(t, 2, unusualdatabase.Options{Extensions: true})
+
+	insert(t, clients[0], "doomed=1")
+	waitForValue(t, clients[1], "doomed=1")
+	clients[1].SendPacket([]byte("!del doomed"))
+	assertPacket(t, "!del doomed=1", clients[1].ReadPacket())
+	waitForValue(t, clients[0], "doomed=")
+	clients[0].SendPacket([]byte("!list "))
+	assertPacket(t, "!list 1/1 =", clients[0].ReadPacket())
+}
+
+func TestClusterVersionsSurviveRestarts(t *testing.T) {
+	dir := t.TempDir()
+	opts := unusualdatabase.Options{DataDir: dir, NodeName: "a", PeerSecret: "secret", PeerAddress: "localhost:"}
+	server, client := startPersistent(t, opts)
+	insert(t, client, "key=old")
+	server.Close()
+	client.Close()
+
+	other, otherClient := startPersistent(t, unusualdatabase.Options{NodeName: "b", PeerSecret: "secret", PeerAddress: "localhost:"})
+	defer other.Close()
+	defer otherClient.Close()
+	insert(t, otherClient, "key=new")
+
+	// The write made on the other node since is later, so it wins even
+	// though it's older than this node's restart
+	opts.Peers = []string{other.(interface{ PeerAddr() net.Addr }).PeerAddr().String()}
+	server, client = startPersistent(t, opts)
+	defer server.Close()
+	defer client.Close()
+	waitForValue(t, client, "key=new")
+	insert(t, client, "key=newer")
+	waitForValue(t, otherClient, "key=newer")
+}
+
+func TestTCPClientsShareTheStore(t *testing.T) {
+	server, client := startPersistent(t, unusualdatabase.Options{TCPAddress: "localhost:", Extensions: true})
+	defer server.Close()
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", server.(interface{ TCPAddr() net.Addr }).TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(conn)
+	expectLine := func(expected string) {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("Expected `%s` but got nothing: %v", expected, lines.Err())
+		}
+		if lines.Text() != expected {
+			t.Fatalf("Expected `%s` but got `%s`", expected, lines.Text())
+		}
+	}
+
+	insert(t, client, "from/udp=1")
+	fmt.Fprintf(conn, "from/udp\nfrom/tcp=2\r\n%s=ignored\nfrom/tcp\n", strings.Repeat("x", 1000))
+	expectLine("from/udp=1")
+	expectLine("from/tcp=2")
+	client.SendPacket([]byte("from/tcp"))
+	assertPacket(t, "from/tcp=2", client.ReadPacket())
+
+	// Listings have a line for each key
+	fmt.Fprintf(conn, "!list from/\n")
+	expectLine("!list 1/2 from/=from/tcp")
+	expectLine("!list 2/2 from/=from/udp")
+	fmt.Fprintf(conn, "version\n")
+	expectLine("version=unusualdatabase " + unusualdatabase.DEFAULT_VERSION)
+}
+
+func TestTCPEscapesNewlines(t *testing.T) {
+	server, client := startPersistent(t, unusualdatabase.Options{TCPAddress: "localhost:"})
+	defer server.Close()
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", server.(interface{ TCPAddr() net.Addr }).TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(conn)
+	expectLine := func(expected string) {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("Expected `%s` but got nothing: %v", expected, lines.Err())
+		}
+		if lines.Text() != expected {
+			t.Fatalf("Expected `%s` but got `%s`", expected, lines.Text())
+		}
+	}
+
+	// Responses stay a line each whatever was stored over UDP
+	insert(t, client, "multi\nline=a\nb\r\nc\\d", "other=1")
+	fmt.Fprintf(conn, "multi\\nline\nother\n")
+	expectLine(`multi\nline=a\nb\r\nc\\d`)
+	expectLine("other=1")
+
+	// And anything can be stored over TCP
+	fmt.Fprintf(conn, "from/tcp=x\\ny\\\\n\\z\nfrom/tcp\n")
+	expectLine(`from/tcp=x\ny\\n\\z`)
+	client.SendPacket([]byte("from/tcp"))
+	assertPacket(t, "from/tcp=x\ny\\n\\z", client.ReadPacket())
+}
+
+func TestHTTPAPI(t *testing.T) {
+	server, client := startPersistent(t, unusualdatabase.Options{HTTPAddress: "localhost:", Version: "1.0"})
+	defer server.Close()
+	defer client.Close()
+	base := "http://" + server.(interface{ HTTPAddr() net.Addr }).HTTPAddr().String()
+
+	request := func(method string, path string, body string, status int, expected string) {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d but got %d: %s", method, path, status, resp.StatusCode, got)
+		}
+		if expected != "" && strings.TrimSpace(string(got)) != expected {
+			t.Fatalf("%s %s: expected `%s` but got `%s`", method, path, expected, got)
+		}
+	}
+
+	insert(t, client, "from udp=1")
+	request("GET", "/keys/from%20udp", "", http.StatusOK, `{"key":"from udp","value":"1"}`)
+	request("GET", "/keys/missing", "", http.StatusNotFound, "")
+	request("GET", "/keys/version", "", http.StatusOK, `{"key":"version","value":"1.0"}`)
+
+	request("PUT", "/keys/a//path", `{"value":"x=y"}`, http.StatusOK, `{"key":"a//path","value":"x=y"}`)
+	client.SendPacket([]byte("a//path"))
+	assertPacket(t, "a//path=x=y", client.ReadPacket())
+	request("PUT", "/keys/short", `{"value":"lived","ttl":"50ms"}`, http.StatusOK, "")
+	request("GET", "/keys?prefix=", "", http.StatusOK, `{"keys":["a//path","from udp","short"]}`)
+	time.Sleep(60 * time.Millisecond)
+	request("GET", "/keys?prefix=", "", http.StatusOK, `{"keys":["a//path","from udp"]}`)
+
+	request("DELETE", "/keys/from%20udp", "", http.StatusNoContent, "")
+	request("DELETE", "/keys/from%20udp", "", http.StatusNotFound, "")
+	client.SendPacket([]byte("from udp"))
+	assertPacket(t, "from udp=", client.ReadPacket())
+
+	request("PUT", "/keys/version", `{"value":"2.0"}`, http.StatusForbidden, "")
+	request("DELETE", "/keys/version", "", http.StatusForbidden, "")
+	request("PUT", "/keys/a=b", `{"value":""}`, http.StatusBadRequest, "")
+	request("PUT", "/keys/big", fmt.Sprintf(`{"value":"%s"}`, strings.Repeat("x", 1000)), http.StatusRequestEntityTooLarge, "")
+	request("PUT", "/keys/bad", `{"value":`, http.StatusBadRequest, "")
+	request("POST", "/keys/bad", "", http.StatusMethodNotAllowed, "")
+	request("GET", "/other", "", http.StatusNotFound, "")
+	request("GET", "/keys?prefix=a", "", http.StatusOK, `{"keys":["a//path"]}`)
+}
+
+func benchmarkClients(b *testing.B, opts unusualdatabase.Options) {
+	server, err := unusualdatabase.ServeWithOptions("localhost:", opts)
+	if err != nil {
+		b.Fatalf("Failed to start server: %s\n", err)
+	}
+	defer server.Close()
+
+	var clients int32
+	b.SetParallelism(16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("udp", server.Addr().String())
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		key := fmt.Sprintf("client%d", atomic.AddInt32(&clients, 1))
+		insert := []byte(key + "=some value")
+		retrieve := []byte(key)
+		p := make([]byte, 1000)
+
+		for pb.Next() {
+			conn.Write(insert)
+			// Datagrams can get lost under load, in which case the request
+			// is simply sent again
+			for {
+				conn.Write(retrieve)
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if _, err := conn.Read(p); err == nil {
+					break
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkConcurrentClients(b *testing.B) {
+	b.Run("SingleWorker", func(b *testing.B) {
+		benchmarkClients(b, unusualdatabase.Options{Workers: 1})
+	})
+	b.Run("WorkerPerCPU", func(b *testing.B) {
+		benchmarkClients(b, unusualdatabase.Options{})
+	})
+}
+
 func assertPacket(t *testing.T, expected string, packet []byte) {
 	if string(packet) != expected {
 		t.Fatalf("Expected `%s` but got `%s`", expected, string(packet))
@@ -117,7 +994,7 @@ func StartUDPClient(address string) (*UDPClient, error) {
 			p := make([]byte, 1000)
 			n, _, err := conn.ReadFrom(p)
 			if err != nil {
-				continue
+				return
 			}
 			ch <- p[:n]
 		}